@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// accessOptions restrict who may talk to the plugin and admin sockets.
+// Anyone who can create endpoints gets to create interfaces and routes on
+// the host.
+type accessOptions struct {
+	// Owner and Group of the sockets, names or ids, unchanged when empty
+	Owner string `toml:"owner" json:"owner"`
+	Group string `toml:"group" json:"group"`
+	// Mode of the sockets, in octal
+	Mode string `toml:"mode" json:"mode"`
+	// AllowUsers and AllowGroups list, comma separated, the users and
+	// groups whose processes may connect
+	AllowUsers  string `toml:"allow_users" json:"allow_users"`
+	AllowGroups string `toml:"allow_groups" json:"allow_groups"`
+}
+
+// peerAccess is the allow list checked against the credentials of the
+// peers.
+type peerAccess struct {
+	uids map[uint32]bool
+	gids map[uint32]bool
+}
+
+func lookupID(name string, group bool) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	var id string
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return 0, err
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, err
+		}
+		id = u.Uid
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
+
+func lookupIDs(list string, group bool) (map[uint32]bool, error) {
+	ids := map[uint32]bool{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		id, err := lookupID(name, group)
+		if err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+func (o *accessOptions) peerAccess() (*peerAccess, error) {
+	uids, err := lookupIDs(o.AllowUsers, false)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := lookupIDs(o.AllowGroups, true)
+	if err != nil {
+		return nil, err
+	}
+	return &peerAccess{uids: uids, gids: gids}, nil
+}
+
+// secure sets the owner and mode of a socket the plugin created.
+func (o *accessOptions) secure(path string) error {
+	uid, gid := -1, -1
+	if o.Owner != "" {
+		id, err := lookupID(o.Owner, false)
+		if err != nil {
+			return err
+		}
+		uid = int(id)
+	}
+	if o.Group != "" {
+		id, err := lookupID(o.Group, true)
+		if err != nil {
+			return err
+		}
+		gid = int(id)
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return err
+	}
+	if o.Mode != "" {
+		mode, err := strconv.ParseUint(o.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket mode %q", o.Mode)
+		}
+		return os.Chmod(path, os.FileMode(mode))
+	}
+	return nil
+}
+
+// peerCredListener closes the unix connections of the peers the allow
+// list does not name. TCP connections are authenticated by TLS.
+type peerCredListener struct {
+	net.Listener
+	access *peerAccess
+}
+
+func (a *peerAccess) listener(l net.Listener) net.Listener {
+	return &peerCredListener{Listener: l, access: a}
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		unixConn, ok := conn.(*net.UnixConn)
+		if !ok {
+			return conn, nil
+		}
+		cred, err := peerCred(unixConn)
+		if err != nil {
+			log.Warnf("Denied connection on %s: unable to read peer credentials: %s", l.Addr(), err)
+			conn.Close()
+			continue
+		}
+		if !l.access.uids[cred.Uid] && !l.access.gids[cred.Gid] {
+			log.Warnf("Denied connection on %s from pid %d uid %d gid %d", l.Addr(), cred.Pid, cred.Uid, cred.Gid)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func peerCred(conn *net.UnixConn) (*syscall.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
@@ -0,0 +1,240 @@
+package admin
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/jc-m/test-docker-plugin/routed/metrics"
+	"net/http"
+	"time"
+)
+
+// Version is the prefix of every admin API path.
+const Version = "v1"
+
+// Admin is implemented by the driver to expose and manage its state. Calls
+// take the same locks as the plugin calls.
+type Admin interface {
+	Networks() []Network
+	Endpoints() []Endpoint
+	Pools() []Pool
+	Allocations() []Allocation
+	Aliases() []Alias
+	Routes() []Route
+	Nodes() []Node
+	ReserveAddress(poolID string, r *ReserveRequest) (*Allocation, error)
+	SetAlias(alias string, r *AliasRequest) error
+	RemoveAlias(alias string) error
+	DrainNetwork(networkID string, drain bool) error
+	Cleanup(dryRun bool) (*CleanupReport, error)
+	Doctor() []Check
+	Stats() []EndpointStats
+}
+
+type Network struct {
+	ID         string
+	Subnets    []string
+	Internal   bool
+	Draining   bool
+	Masquerade bool
+	Gateway    string `json:",omitempty"`
+	Peers      []string
+	VIPs       map[string]string
+	Endpoints  []string
+}
+
+type Endpoint struct {
+	ID            string
+	NetworkID     string
+	HostInterface string
+	MacAddress    string
+	IPv4Address   string
+	IPv6Address   string `json:",omitempty"`
+	IPAliases     []string
+	Service       string `json:",omitempty"`
+	Health        string `json:",omitempty"`
+	PortMapping   []string
+}
+
+type Pool struct {
+	ID        string
+	Subnet    string
+	Gateway   string
+	Allocated int
+	Free      int
+}
+
+type Allocation struct {
+	PoolID  string
+	Address string
+}
+
+type Alias struct {
+	Alias      string
+	NetworkID  string
+	EndpointID string
+	// Active is false while the alias is withdrawn because its endpoint
+	// is unhealthy or its network drained.
+	Active bool
+}
+
+type Route struct {
+	Destination string
+	Interface   string
+	NetworkID   string
+	EndpointID  string
+}
+
+type Node struct {
+	Address string
+	Self    bool
+	Since   time.Time
+}
+
+// ReserveRequest reserves an address of a pool so that IPAM never hands it
+// out.
+type ReserveRequest struct {
+	Address string
+}
+
+// AliasRequest assigns an alias to an endpoint, moving it away from the
+// endpoint holding it if any.
+type AliasRequest struct {
+	NetworkID  string
+	EndpointID string
+}
+
+// CleanupReport lists the host state left behind by endpoints the driver
+// no longer knows about.
+type CleanupReport struct {
+	DryRun     bool
+	Interfaces []string
+}
+
+// Check is the result of one doctor check.
+type Check struct {
+	Name   string
+	OK     bool
+	Detail string `json:",omitempty"`
+}
+
+// EndpointStats are the counters of the host interface of a joined
+// endpoint. Rx is what the container sent.
+type EndpointStats struct {
+	NetworkID     string
+	EndpointID    string
+	HostInterface string
+	RxBytes       uint64
+	RxPackets     uint64
+	TxBytes       uint64
+	TxPackets     uint64
+}
+
+type errorResp struct {
+	Err string
+}
+
+// Handler returns the handler of the admin API of a.
+func Handler(a Admin) http.Handler {
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	v := router.PathPrefix("/" + Version).Subrouter()
+
+	v.Methods("GET").Path("/networks").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objectResponse(w, a.Networks())
+	})
+	v.Methods("GET").Path("/endpoints").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objectResponse(w, a.Endpoints())
+	})
+	v.Methods("GET").Path("/pools").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objectResponse(w, a.Pools())
+	})
+	v.Methods("GET").Path("/allocations").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objectResponse(w, a.Allocations())
+	})
+	v.Methods("GET").Path("/aliases").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objectResponse(w, a.Aliases())
+	})
+	v.Methods("GET").Path("/routes").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objectResponse(w, a.Routes())
+	})
+	v.Methods("GET").Path("/nodes").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objectResponse(w, a.Nodes())
+	})
+	v.Methods("GET").Path("/stats").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objectResponse(w, a.Stats())
+	})
+
+	v.Methods("POST").Path("/pools/{id}/reserve").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ReserveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, "Could not decode JSON payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		alloc, err := a.ReserveAddress(mux.Vars(r)["id"], &req)
+		objectOrErrorResponse(w, alloc, err)
+	})
+	v.Methods("PUT").Path("/aliases/{alias:.+}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AliasRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, "Could not decode JSON payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		emptyOrErrorResponse(w, a.SetAlias(mux.Vars(r)["alias"], &req))
+	})
+	v.Methods("DELETE").Path("/aliases/{alias:.+}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		emptyOrErrorResponse(w, a.RemoveAlias(mux.Vars(r)["alias"]))
+	})
+	v.Methods("POST").Path("/networks/{id}/drain").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		emptyOrErrorResponse(w, a.DrainNetwork(mux.Vars(r)["id"], true))
+	})
+	v.Methods("DELETE").Path("/networks/{id}/drain").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		emptyOrErrorResponse(w, a.DrainNetwork(mux.Vars(r)["id"], false))
+	})
+
+	v.Methods("POST").Path("/cleanup").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, err := a.Cleanup(r.URL.Query().Get("dry-run") != "")
+		objectOrErrorResponse(w, report, err)
+	})
+	v.Methods("GET").Path("/doctor").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objectResponse(w, a.Doctor())
+	})
+
+	// unversioned, where Prometheus expects it
+	router.Methods("GET").Path("/metrics").Handler(metrics.Handler(collector(a)))
+
+	return router
+}
+
+// Message processing
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	log.Warnf("admin Not found: [ %+v ]", r)
+	sendError(w, "not found", http.StatusNotFound)
+}
+
+func sendError(w http.ResponseWriter, msg string, code int) {
+	log.Errorf("%d %s", code, msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&errorResp{Err: msg})
+}
+
+func objectResponse(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		sendError(w, "Could not JSON encode response", http.StatusInternalServerError)
+	}
+}
+
+func objectOrErrorResponse(w http.ResponseWriter, obj interface{}, err error) {
+	if err != nil {
+		sendError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	objectResponse(w, obj)
+}
+
+func emptyOrErrorResponse(w http.ResponseWriter, err error) {
+	objectOrErrorResponse(w, map[string]string{}, err)
+}
@@ -0,0 +1,127 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Client talks to the admin API of a running plugin.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client for the admin API served on the unix socket.
+func NewClient(socket string) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) call(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://routed/"+Version+path, &body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e errorResp
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Err == "" {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s", e.Err)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) Networks() ([]Network, error) {
+	var networks []Network
+	return networks, c.call("GET", "/networks", nil, &networks)
+}
+
+func (c *Client) Endpoints() ([]Endpoint, error) {
+	var endpoints []Endpoint
+	return endpoints, c.call("GET", "/endpoints", nil, &endpoints)
+}
+
+func (c *Client) Pools() ([]Pool, error) {
+	var pools []Pool
+	return pools, c.call("GET", "/pools", nil, &pools)
+}
+
+func (c *Client) Allocations() ([]Allocation, error) {
+	var allocations []Allocation
+	return allocations, c.call("GET", "/allocations", nil, &allocations)
+}
+
+func (c *Client) Aliases() ([]Alias, error) {
+	var aliases []Alias
+	return aliases, c.call("GET", "/aliases", nil, &aliases)
+}
+
+func (c *Client) Routes() ([]Route, error) {
+	var routes []Route
+	return routes, c.call("GET", "/routes", nil, &routes)
+}
+
+func (c *Client) Nodes() ([]Node, error) {
+	var nodes []Node
+	return nodes, c.call("GET", "/nodes", nil, &nodes)
+}
+
+func (c *Client) ReserveAddress(poolID string, r *ReserveRequest) (*Allocation, error) {
+	var alloc Allocation
+	return &alloc, c.call("POST", "/pools/"+url.QueryEscape(poolID)+"/reserve", r, &alloc)
+}
+
+func (c *Client) SetAlias(alias string, r *AliasRequest) error {
+	return c.call("PUT", "/aliases/"+alias, r, nil)
+}
+
+func (c *Client) RemoveAlias(alias string) error {
+	return c.call("DELETE", "/aliases/"+alias, nil, nil)
+}
+
+func (c *Client) DrainNetwork(networkID string, drain bool) error {
+	method := "POST"
+	if !drain {
+		method = "DELETE"
+	}
+	return c.call(method, "/networks/"+url.QueryEscape(networkID)+"/drain", nil, nil)
+}
+
+func (c *Client) Cleanup(dryRun bool) (*CleanupReport, error) {
+	path := "/cleanup"
+	if dryRun {
+		path += "?dry-run=1"
+	}
+	var report CleanupReport
+	return &report, c.call("POST", path, nil, &report)
+}
+
+func (c *Client) Doctor() ([]Check, error) {
+	var checks []Check
+	return checks, c.call("GET", "/doctor", nil, &checks)
+}
@@ -0,0 +1,40 @@
+package admin
+
+import (
+	"github.com/jc-m/test-docker-plugin/routed/metrics"
+)
+
+// collector writes the driver state metrics, read at scrape time.
+func collector(a Admin) func(w *metrics.Writer) {
+	return func(w *metrics.Writer) {
+		var allocated, free []metrics.Sample
+		for _, p := range a.Pools() {
+			allocated = append(allocated, metrics.Sample{Values: []string{p.ID, p.Subnet}, Value: float64(p.Allocated)})
+			free = append(free, metrics.Sample{Values: []string{p.ID, p.Subnet}, Value: float64(p.Free)})
+		}
+		w.Gauge("routed_pool_allocated_addresses", "Addresses allocated from the IPAM pool.",
+			[]string{"pool", "subnet"}, allocated)
+		w.Gauge("routed_pool_free_addresses", "Addresses left in the IPAM pool.",
+			[]string{"pool", "subnet"}, free)
+
+		var endpoints []metrics.Sample
+		for _, n := range a.Networks() {
+			endpoints = append(endpoints, metrics.Sample{Values: []string{n.ID}, Value: float64(len(n.Endpoints))})
+		}
+		w.Gauge("routed_network_endpoints", "Endpoints of the network.", []string{"network"}, endpoints)
+
+		var rxBytes, rxPackets, txBytes, txPackets []metrics.Sample
+		for _, s := range a.Stats() {
+			values := []string{s.NetworkID, s.EndpointID, s.HostInterface}
+			rxBytes = append(rxBytes, metrics.Sample{Values: values, Value: float64(s.RxBytes)})
+			rxPackets = append(rxPackets, metrics.Sample{Values: values, Value: float64(s.RxPackets)})
+			txBytes = append(txBytes, metrics.Sample{Values: values, Value: float64(s.TxBytes)})
+			txPackets = append(txPackets, metrics.Sample{Values: values, Value: float64(s.TxPackets)})
+		}
+		labels := []string{"network", "endpoint", "interface"}
+		w.Counter("routed_endpoint_rx_bytes_total", "Bytes sent by the endpoint, received on its host interface.", labels, rxBytes)
+		w.Counter("routed_endpoint_rx_packets_total", "Packets sent by the endpoint, received on its host interface.", labels, rxPackets)
+		w.Counter("routed_endpoint_tx_bytes_total", "Bytes sent to the endpoint on its host interface.", labels, txBytes)
+		w.Counter("routed_endpoint_tx_packets_total", "Packets sent to the endpoint on its host interface.", labels, txPackets)
+	}
+}
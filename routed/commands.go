@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jc-m/test-docker-plugin/routed/admin"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+type command struct {
+	usage string
+	run   func(c *admin.Client, out output, args []string) error
+}
+
+var commands = map[string]command{
+	"ls":      {"ls networks|endpoints|pools", listCmd},
+	"inspect": {"inspect <endpoint>", inspectCmd},
+	"alias":   {"alias add <alias> <endpoint> | alias rm <alias>", aliasCmd},
+	"reserve": {"reserve <pool> <address>", reserveCmd},
+	"cleanup": {"cleanup [-n]", cleanupCmd},
+	"doctor":  {"doctor", doctorCmd},
+}
+
+// output prints either human tables or JSON.
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+func (o output) table(v interface{}, header string, rows func(w io.Writer)) error {
+	if o.json {
+		enc, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(o.w, string(enc))
+		return nil
+	}
+	tw := tabwriter.NewWriter(o.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	rows(tw)
+	return tw.Flush()
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options]                    serve the plugin\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s <command> [-o json] [args]  query the running plugin\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s replay [-datapath netns|host] [-config file] <recording>\n\nCommands:\n", os.Args[0])
+	for _, name := range []string{"ls", "inspect", "alias", "reserve", "cleanup", "doctor"} {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a client subcommand against the admin socket and returns
+// the exit status.
+func runCommand(args []string) int {
+	if args[0] == "replay" {
+		return runReplay(args[1:])
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage()
+		return 2
+	}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	socket := flags.String("admin-socket", "/run/routed/admin.sock", "admin socket of the running plugin")
+	format := flags.String("o", "table", "output format (table, json)")
+	dryRun := flags.Bool("n", false, "cleanup: only report what would be removed")
+	// options may follow the arguments, as in "ls endpoints -o json"
+	var cmdArgs []string
+	for rest := args[1:]; ; {
+		if err := flags.Parse(rest); err != nil {
+			return 2
+		}
+		rest = flags.Args()
+		if len(rest) == 0 {
+			break
+		}
+		cmdArgs, rest = append(cmdArgs, rest[0]), rest[1:]
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *format)
+		return 2
+	}
+	if args[0] == "cleanup" && *dryRun {
+		cmdArgs = append(cmdArgs, "-n")
+	}
+	err := cmd.run(admin.NewClient(*socket), output{w: os.Stdout, json: *format == "json"}, cmdArgs)
+	if err == errUsage {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], cmd.usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+var errUsage = fmt.Errorf("usage")
+
+func short(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func listCmd(c *admin.Client, out output, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "networks":
+		networks, err := c.Networks()
+		if err != nil {
+			return err
+		}
+		return out.table(networks, "NETWORK ID\tSUBNETS\tINTERNAL\tDRAINING\tENDPOINTS", func(w io.Writer) {
+			for _, n := range networks {
+				fmt.Fprintf(w, "%s\t%s\t%t\t%t\t%d\n", short(n.ID), strings.Join(n.Subnets, ","), n.Internal, n.Draining, len(n.Endpoints))
+			}
+		})
+	case "endpoints":
+		endpoints, err := c.Endpoints()
+		if err != nil {
+			return err
+		}
+		return out.table(endpoints, "ENDPOINT ID\tNETWORK ID\tINTERFACE\tIPV4 ADDRESS\tALIASES\tHEALTH", func(w io.Writer) {
+			for _, e := range endpoints {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", short(e.ID), short(e.NetworkID), e.HostInterface,
+					e.IPv4Address, strings.Join(e.IPAliases, ","), e.Health)
+			}
+		})
+	case "pools":
+		pools, err := c.Pools()
+		if err != nil {
+			return err
+		}
+		return out.table(pools, "POOL ID\tSUBNET\tGATEWAY\tALLOCATED\tFREE", func(w io.Writer) {
+			for _, p := range pools {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", p.ID, p.Subnet, p.Gateway, p.Allocated, p.Free)
+			}
+		})
+	}
+	return errUsage
+}
+
+// findEndpoint resolves an endpoint ID or unique ID prefix.
+func findEndpoint(c *admin.Client, id string) (*admin.Endpoint, error) {
+	endpoints, err := c.Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	var found *admin.Endpoint
+	for i, e := range endpoints {
+		if !strings.HasPrefix(e.ID, id) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("endpoint prefix %s is ambiguous", id)
+		}
+		found = &endpoints[i]
+	}
+	if found == nil {
+		return nil, fmt.Errorf("endpoint %s not found", id)
+	}
+	return found, nil
+}
+
+func inspectCmd(c *admin.Client, out output, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	e, err := findEndpoint(c, args[0])
+	if err != nil {
+		return err
+	}
+	routes, err := c.Routes()
+	if err != nil {
+		return err
+	}
+	var epRoutes []string
+	for _, r := range routes {
+		if r.EndpointID == e.ID {
+			epRoutes = append(epRoutes, r.Destination)
+		}
+	}
+	if out.json {
+		return out.table(struct {
+			admin.Endpoint
+			Routes []string
+		}{*e, epRoutes}, "", nil)
+	}
+	tw := tabwriter.NewWriter(out.w, 0, 8, 2, ' ', 0)
+	for _, kv := range [][2]string{
+		{"Endpoint", e.ID},
+		{"Network", e.NetworkID},
+		{"Host interface", e.HostInterface},
+		{"MAC address", e.MacAddress},
+		{"IPv4 address", e.IPv4Address},
+		{"IPv6 address", e.IPv6Address},
+		{"Aliases", strings.Join(e.IPAliases, ", ")},
+		{"Service", e.Service},
+		{"Health", e.Health},
+		{"Published ports", strings.Join(e.PortMapping, ", ")},
+		{"Routes", strings.Join(epRoutes, ", ")},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", kv[0], kv[1])
+	}
+	return tw.Flush()
+}
+
+func aliasCmd(c *admin.Client, out output, args []string) error {
+	switch {
+	case len(args) == 3 && args[0] == "add":
+		e, err := findEndpoint(c, args[2])
+		if err != nil {
+			return err
+		}
+		return c.SetAlias(args[1], &admin.AliasRequest{NetworkID: e.NetworkID, EndpointID: e.ID})
+	case len(args) == 2 && args[0] == "rm":
+		return c.RemoveAlias(args[1])
+	}
+	return errUsage
+}
+
+func reserveCmd(c *admin.Client, out output, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	alloc, err := c.ReserveAddress(args[0], &admin.ReserveRequest{Address: args[1]})
+	if err != nil {
+		return err
+	}
+	return out.table(alloc, "POOL ID\tADDRESS", func(w io.Writer) {
+		fmt.Fprintf(w, "%s\t%s\n", alloc.PoolID, alloc.Address)
+	})
+}
+
+func cleanupCmd(c *admin.Client, out output, args []string) error {
+	dryRun := len(args) == 1 && args[0] == "-n"
+	if len(args) > 1 || (len(args) == 1 && !dryRun) {
+		return errUsage
+	}
+	report, err := c.Cleanup(dryRun)
+	if err != nil {
+		return err
+	}
+	action := "REMOVED"
+	if dryRun {
+		action = "WOULD REMOVE"
+	}
+	return out.table(report, action, func(w io.Writer) {
+		for _, name := range report.Interfaces {
+			fmt.Fprintf(w, "interface %s\n", name)
+		}
+	})
+}
+
+func doctorCmd(c *admin.Client, out output, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	checks, err := c.Doctor()
+	if err != nil {
+		return fmt.Errorf("plugin not reachable on its admin socket: %s", err)
+	}
+	failed := 0
+	err = out.table(checks, "CHECK\tSTATUS\tDETAIL", func(w io.Writer) {
+		for _, ch := range checks {
+			status := "ok"
+			if !ch.OK {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", ch.Name, status, ch.Detail)
+		}
+	})
+	for _, ch := range checks {
+		if !ch.OK {
+			failed++
+		}
+	}
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d checks failed", failed)
+	}
+	return err
+}
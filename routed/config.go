@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/jc-m/test-docker-plugin/routed/driver"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// options are the plugin settings. They come from the configuration file,
+// TOML or JSON, and the command line, which wins.
+type options struct {
+	Name            string     `toml:"name" json:"name"`
+	Socket          string     `toml:"socket" json:"socket"`
+	TCP             tcpOptions `toml:"tcp" json:"tcp"`
+	SpecDir         string     `toml:"spec_dir" json:"spec_dir"`
+	Record          string     `toml:"record" json:"record"`
+	CleanupOnExit   bool       `toml:"cleanup_on_exit" json:"cleanup_on_exit"`
+	ShutdownTimeout duration   `toml:"shutdown_timeout" json:"shutdown_timeout"`
+	// RPCTimeout is the deadline of the plugin calls, RPCTimeouts
+	// overrides it by call, such as "NetworkDriver.Join"
+	RPCTimeout  duration            `toml:"rpc_timeout" json:"rpc_timeout"`
+	RPCTimeouts map[string]duration `toml:"rpc_timeouts" json:"rpc_timeouts"`
+	Log         logOptions          `toml:"log" json:"log"`
+	Access      accessOptions       `toml:"access" json:"access"`
+	Admin       adminOptions        `toml:"admin" json:"admin"`
+	IPAM        ipamOptions         `toml:"ipam" json:"ipam"`
+	Datapath    datapathOptions     `toml:"datapath" json:"datapath"`
+}
+
+type logOptions struct {
+	Level  string `toml:"level" json:"level"`
+	Format string `toml:"format" json:"format"`
+	Syslog string `toml:"syslog" json:"syslog"`
+}
+
+type adminOptions struct {
+	Socket string `toml:"socket" json:"socket"`
+}
+
+type ipamOptions struct {
+	Pool               string `toml:"pool" json:"pool"`
+	Gateway            string `toml:"gateway" json:"gateway"`
+	LocalAddressSpace  string `toml:"local_address_space" json:"local_address_space"`
+	GlobalAddressSpace string `toml:"global_address_space" json:"global_address_space"`
+}
+
+type datapathOptions struct {
+	MTU             int    `toml:"mtu" json:"mtu"`
+	InterfacePrefix string `toml:"interface_prefix" json:"interface_prefix"`
+	UserlandProxy   bool   `toml:"userland_proxy" json:"userland_proxy"`
+	FixSysctls      bool   `toml:"fix_sysctls" json:"fix_sysctls"`
+	IPv6            bool   `toml:"ipv6" json:"ipv6"`
+	GARPCount       int    `toml:"garp_count" json:"garp_count"`
+	StaticNeighbors bool   `toml:"static_neighbors" json:"static_neighbors"`
+}
+
+// duration reads "30s" in both file formats and on the command line.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+// UnmarshalTOML reads the values of the rpc_timeouts table, which the toml
+// decoder only passes to UnmarshalText for struct fields.
+func (d *duration) UnmarshalTOML(v interface{}) error {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("invalid duration %v", v)
+	}
+	return d.Set(s)
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func defaultOptions() *options {
+	return &options{
+		Name:            "routed",
+		Socket:          "/run/docker/plugins/routed.sock",
+		SpecDir:         "/etc/docker/plugins",
+		ShutdownTimeout: duration{30 * time.Second},
+		RPCTimeout:      duration{server.DefaultTimeout},
+		Log: logOptions{
+			Level:  "info",
+			Format: "text",
+		},
+		Access: accessOptions{
+			Mode:       "0660",
+			AllowUsers: "0",
+		},
+		Admin: adminOptions{
+			Socket: "/run/routed/admin.sock",
+		},
+		IPAM: ipamOptions{
+			Pool:               driver.DefaultPool,
+			Gateway:            driver.DefaultGateway,
+			LocalAddressSpace:  driver.DefaultLocalAddressSpace,
+			GlobalAddressSpace: driver.DefaultGlobalAddressSpace,
+		},
+		Datapath: datapathOptions{
+			MTU:             driver.DefaultMTU,
+			InterfacePrefix: driver.DefaultInterfacePrefix,
+			UserlandProxy:   true,
+			GARPCount:       3,
+		},
+	}
+}
+
+// register binds the flags to the options, their current values being the
+// defaults.
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.Name, "name", o.Name, "plugin name in the spec file written for -tcp")
+	fs.StringVar(&o.Socket, "socket", o.Socket, "socket on which to listen")
+	fs.StringVar(&o.TCP.Address, "tcp", o.TCP.Address, "listen on this TCP host:port instead of the socket")
+	fs.StringVar(&o.TCP.Advertise, "tcp-advertise", o.TCP.Advertise, "host:port docker dials, the -tcp address by default")
+	fs.StringVar(&o.TCP.TLSCert, "tls-cert", o.TCP.TLSCert, "certificate of the TCP listener, enables TLS")
+	fs.StringVar(&o.TCP.TLSKey, "tls-key", o.TCP.TLSKey, "key of the -tls-cert certificate")
+	fs.StringVar(&o.TCP.TLSCA, "tls-ca", o.TCP.TLSCA, "CA of the client certificates, enables mutual TLS")
+	fs.StringVar(&o.TCP.DockerCA, "docker-tls-ca", o.TCP.DockerCA, "CA docker verifies the plugin certificate with")
+	fs.StringVar(&o.TCP.DockerCert, "docker-tls-cert", o.TCP.DockerCert, "client certificate docker presents")
+	fs.StringVar(&o.TCP.DockerKey, "docker-tls-key", o.TCP.DockerKey, "key of the -docker-tls-cert certificate")
+	fs.StringVar(&o.SpecDir, "spec-dir", o.SpecDir, "directory where the spec file of the -tcp listener is written")
+	fs.StringVar(&o.Record, "record", o.Record, "append every plugin request and response to this file, for routed replay")
+	fs.BoolVar(&o.CleanupOnExit, "cleanup-on-exit", o.CleanupOnExit, "remove the interfaces, routes and iptables rules of all networks on exit")
+	fs.Var(&o.ShutdownTimeout, "shutdown-timeout", "time given to the requests in flight on exit")
+	fs.Var(&o.RPCTimeout, "rpc-timeout", "deadline of the plugin calls (0 disables)")
+	fs.StringVar(&o.Log.Level, "log-level", o.Log.Level, "logging level (debug, info, warning, error)")
+	fs.StringVar(&o.Log.Format, "log-format", o.Log.Format, "logging format (text, json, logstash)")
+	fs.StringVar(&o.Log.Syslog, "syslog", o.Log.Syslog, "also log to syslog: \"local\" or network://address, such as udp://localhost:514")
+	fs.StringVar(&o.Access.Owner, "socket-owner", o.Access.Owner, "owner of the plugin and admin sockets")
+	fs.StringVar(&o.Access.Group, "socket-group", o.Access.Group, "group of the plugin and admin sockets")
+	fs.StringVar(&o.Access.Mode, "socket-mode", o.Access.Mode, "mode of the plugin and admin sockets")
+	fs.StringVar(&o.Access.AllowUsers, "allow-users", o.Access.AllowUsers, "comma separated users whose processes may connect to the sockets")
+	fs.StringVar(&o.Access.AllowGroups, "allow-groups", o.Access.AllowGroups, "comma separated groups whose processes may connect to the sockets")
+	fs.StringVar(&o.Admin.Socket, "admin-socket", o.Admin.Socket, "socket on which to serve the admin API (empty to disable)")
+	fs.StringVar(&o.IPAM.Pool, "pool", o.IPAM.Pool, "subnet handed out by IPAM")
+	fs.StringVar(&o.IPAM.Gateway, "gateway", o.IPAM.Gateway, "gateway address of the pool")
+	fs.StringVar(&o.IPAM.LocalAddressSpace, "local-address-space", o.IPAM.LocalAddressSpace, "name of the local default address space")
+	fs.StringVar(&o.IPAM.GlobalAddressSpace, "global-address-space", o.IPAM.GlobalAddressSpace, "name of the global default address space")
+	fs.IntVar(&o.Datapath.MTU, "mtu", o.Datapath.MTU, "MTU of the endpoint interfaces")
+	fs.StringVar(&o.Datapath.InterfacePrefix, "interface-prefix", o.Datapath.InterfacePrefix, "name prefix of the host side of endpoint interfaces")
+	fs.BoolVar(&o.Datapath.UserlandProxy, "userland-proxy", o.Datapath.UserlandProxy, "use the userland proxy for published ports")
+	fs.BoolVar(&o.Datapath.FixSysctls, "fix-sysctls", o.Datapath.FixSysctls, "set the host sysctls required by the datapath")
+	fs.BoolVar(&o.Datapath.IPv6, "ipv6", o.Datapath.IPv6, "manage IPv6 forwarding sysctls")
+	fs.IntVar(&o.Datapath.GARPCount, "garp-count", o.Datapath.GARPCount, "gratuitous ARP/unsolicited NA rounds sent for moved addresses (0 disables)")
+	fs.BoolVar(&o.Datapath.StaticNeighbors, "static-neighbors", o.Datapath.StaticNeighbors, "install permanent neighbor entries for the endpoints on the host veths")
+}
+
+func (o *options) driverConfig() *driver.Config {
+	return &driver.Config{
+		UserlandProxy:      o.Datapath.UserlandProxy,
+		FixSysctls:         o.Datapath.FixSysctls,
+		IPv6:               o.Datapath.IPv6,
+		GARPCount:          o.Datapath.GARPCount,
+		StaticNeighbors:    o.Datapath.StaticNeighbors,
+		Pool:               o.IPAM.Pool,
+		Gateway:            o.IPAM.Gateway,
+		LocalAddressSpace:  o.IPAM.LocalAddressSpace,
+		GlobalAddressSpace: o.IPAM.GlobalAddressSpace,
+		MTU:                o.Datapath.MTU,
+		InterfacePrefix:    o.Datapath.InterfacePrefix,
+	}
+}
+
+func (o *options) serverConfig() *server.Config {
+	config := &server.Config{
+		Timeout:  o.RPCTimeout.Duration,
+		Timeouts: map[string]time.Duration{},
+	}
+	if config.Timeout == 0 {
+		config.Timeout = -1
+	}
+	for rpc, timeout := range o.RPCTimeouts {
+		config.Timeouts[rpc] = timeout.Duration
+	}
+	return config
+}
+
+// loadOptions reads the configuration file, then applies the flags set on
+// the command line over it. A .json file is JSON, anything else TOML.
+func loadOptions(path string) (*options, error) {
+	o := defaultOptions()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(o)
+	} else {
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(data), o)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown settings %v", meta.Undecoded())
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %s", path, err)
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	o.register(fs)
+	flag.Visit(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) != nil {
+			fs.Set(f.Name, f.Value.String())
+		}
+	})
+	return o, nil
+}
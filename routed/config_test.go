@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routed-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		check   func(o *options) bool
+		wantErr bool
+	}{
+		{
+			name: "TOML",
+			file: "routed.toml",
+			content: `rpc_timeout = "10s"
+[rpc_timeouts]
+"NetworkDriver.Join" = "1m"
+[ipam]
+pool = "10.50.0.0/16"
+[datapath]
+fix_sysctls = true
+`,
+			check: func(o *options) bool {
+				return o.IPAM.Pool == "10.50.0.0/16" && o.Datapath.FixSysctls &&
+					o.RPCTimeout.Duration == 10*time.Second &&
+					o.RPCTimeouts["NetworkDriver.Join"].Duration == time.Minute &&
+					// untouched settings keep their defaults
+					o.IPAM.Gateway == defaultOptions().IPAM.Gateway && o.Datapath.UserlandProxy
+			},
+		},
+		{
+			name:    "JSON",
+			file:    "routed.json",
+			content: `{"shutdown_timeout": "5s", "log": {"level": "debug"}, "datapath": {"mtu": 9000}}`,
+			check: func(o *options) bool {
+				return o.ShutdownTimeout.Duration == 5*time.Second && o.Log.Level == "debug" &&
+					o.Datapath.MTU == 9000 && o.Log.Format == "text"
+			},
+		},
+		{name: "unknown TOML setting", file: "unknown.toml", content: "[ipam]\nsubnet = \"10.0.0.0/8\"\n", wantErr: true},
+		{name: "unknown JSON setting", file: "unknown.json", content: `{"ipam": {"subnet": "10.0.0.0/8"}}`, wantErr: true},
+		{name: "invalid duration", file: "duration.toml", content: "rpc_timeout = \"ten\"\n", wantErr: true},
+		{name: "invalid RPC timeout", file: "timeouts.toml", content: "[rpc_timeouts]\n\"NetworkDriver.Join\" = 10\n", wantErr: true},
+		{name: "TOML in a .json file", file: "toml.json", content: "name = \"routed\"\n", wantErr: true},
+		{name: "missing file", file: "missing.toml", wantErr: true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.file)
+		if tt.content != "" {
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		o, err := loadOptions(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !tt.check(o) {
+			t.Errorf("%s: unexpected options %+v", tt.name, o)
+		}
+	}
+}
@@ -0,0 +1,519 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/jc-m/test-docker-plugin/routed/admin"
+	"github.com/vishvananda/netlink"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ======= Admin functions
+
+func (driver *driver) Networks() []admin.Network {
+	networks := []admin.Network{}
+	driver.eachNetwork(func(rnet *routedNetwork) {
+		n := admin.Network{
+			ID:         rnet.id,
+			Internal:   rnet.internal,
+			Draining:   rnet.draining,
+			Masquerade: rnet.masquerade != nil,
+			Subnets:    []string{},
+			Peers:      rnet.peers,
+			VIPs:       map[string]string{},
+			Endpoints:  sortedKeys(rnet.endpoints),
+		}
+		for _, subnet := range rnet.subnets {
+			n.Subnets = append(n.Subnets, subnet.String())
+		}
+		if rnet.gateway != nil {
+			n.Gateway = rnet.gateway.String()
+		}
+		for service, vip := range rnet.vips {
+			n.VIPs[service] = vip.ip.String()
+		}
+		networks = append(networks, n)
+	})
+	return networks
+}
+
+func (driver *driver) Endpoints() []admin.Endpoint {
+	endpoints := []admin.Endpoint{}
+	driver.eachNetwork(func(rnet *routedNetwork) {
+		for _, id := range sortedKeys(rnet.endpoints) {
+			ep := rnet.endpoints[id]
+			e := admin.Endpoint{
+				ID:            id,
+				NetworkID:     rnet.id,
+				HostInterface: ep.iface,
+				IPAliases:     []string{},
+				Service:       ep.service,
+				PortMapping:   []string{},
+			}
+			if ep.macAddress != nil {
+				e.MacAddress = ep.macAddress.String()
+			}
+			if ep.ipv4Address != nil {
+				e.IPv4Address = ep.ipv4Address.String()
+			}
+			if ep.ipv6Address != nil {
+				e.IPv6Address = ep.ipv6Address.String()
+			}
+			for _, ipa := range ep.ipAliases {
+				e.IPAliases = append(e.IPAliases, ipa.String())
+			}
+			if ep.probe != nil {
+				e.Health = ep.probe.healthInfo()[infoHealthStatus].(string)
+			}
+			for _, b := range ep.portMapping {
+				e.PortMapping = append(e.PortMapping, b.String())
+			}
+			endpoints = append(endpoints, e)
+		}
+	})
+	return endpoints
+}
+
+func (driver *driver) Pools() []admin.Pool {
+	pools := []admin.Pool{}
+	driver.eachPool(func(pool *routedPool) {
+		first, last := pool.allocRange()
+		free := 0
+		if last >= first {
+			free = int(last - first + 1)
+		}
+		for addr := range pool.allocatedIPs {
+			if ip, _, err := net.ParseCIDR(addr); err == nil {
+				if i := ipToUint32(ip); i >= first && i <= last {
+					free--
+				}
+			}
+		}
+		pools = append(pools, admin.Pool{
+			ID:        pool.id,
+			Subnet:    pool.subnet.String(),
+			Gateway:   pool.gateway.String(),
+			Allocated: len(pool.allocatedIPs),
+			Free:      free,
+		})
+	})
+	return pools
+}
+
+func (driver *driver) Allocations() []admin.Allocation {
+	allocations := []admin.Allocation{}
+	driver.eachPool(func(pool *routedPool) {
+		for _, addr := range sortedKeys(pool.allocatedIPs) {
+			allocations = append(allocations, admin.Allocation{PoolID: pool.id, Address: addr})
+		}
+	})
+	return allocations
+}
+
+func (driver *driver) Aliases() []admin.Alias {
+	aliases := []admin.Alias{}
+	driver.eachNetwork(func(rnet *routedNetwork) {
+		for _, id := range sortedKeys(rnet.endpoints) {
+			ep := rnet.endpoints[id]
+			for _, ipa := range ep.ipAliases {
+				aliases = append(aliases, admin.Alias{
+					Alias:      ipa.String(),
+					NetworkID:  rnet.id,
+					EndpointID: id,
+					Active:     ep.aliasesRouted,
+				})
+			}
+		}
+	})
+	return aliases
+}
+
+func (driver *driver) Routes() []admin.Route {
+	routes := []admin.Route{}
+	driver.eachNetwork(func(rnet *routedNetwork) {
+		for _, id := range sortedKeys(rnet.endpoints) {
+			ep := rnet.endpoints[id]
+			if ep.iface == "" {
+				continue
+			}
+			link, err := netlink.LinkByName(ep.iface)
+			if err != nil {
+				continue
+			}
+			for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+				list, err := netlink.RouteList(link, family)
+				if err != nil {
+					continue
+				}
+				for _, r := range list {
+					if r.Dst == nil {
+						continue
+					}
+					routes = append(routes, admin.Route{
+						Destination: r.Dst.String(),
+						Interface:   ep.iface,
+						NetworkID:   rnet.id,
+						EndpointID:  id,
+					})
+				}
+			}
+		}
+	})
+	return routes
+}
+
+func (driver *driver) Nodes() []admin.Node {
+	driver.Lock()
+	defer driver.Unlock()
+
+	nodes := []admin.Node{}
+	for _, addr := range sortedKeys(driver.nodes) {
+		n := driver.nodes[addr]
+		nodes = append(nodes, admin.Node{Address: n.address, Self: n.self, Since: n.since})
+	}
+	return nodes
+}
+
+func (driver *driver) ReserveAddress(poolID string, r *admin.ReserveRequest) (*admin.Allocation, error) {
+	pool, err := driver.lockPool(poolID)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Unlock()
+
+	first, last := pool.hostRange()
+	ip := net.ParseIP(r.Address).To4()
+	if ip == nil || ipToUint32(ip) < first || ipToUint32(ip) > last {
+		return nil, fmt.Errorf("%s is not a host address of pool %s", r.Address, poolID)
+	}
+	addr := fmt.Sprintf("%s/32", ip)
+	if pool.allocatedIPs[addr] {
+		return nil, fmt.Errorf("%s already allocated", addr)
+	}
+	pool.allocatedIPs[addr] = true
+	log.Infof("Reserved %s in %s", addr, poolID)
+	return &admin.Allocation{PoolID: poolID, Address: addr}, nil
+}
+
+// parseAlias accepts an alias with or without prefix length, host routes
+// are assumed for the latter.
+func parseAlias(alias string) (*net.IPNet, error) {
+	if !strings.Contains(alias, "/") {
+		ip := net.ParseIP(alias)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid alias %s", alias)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	return netlink.ParseIPNet(alias)
+}
+
+// findAlias returns the endpoint holding the alias and its index in the
+// endpoint aliases.
+func (driver *driver) findAlias(alias *net.IPNet) (*routedNetwork, *routedEndpoint, int) {
+	for _, rnet := range driver.networks {
+		for _, ep := range rnet.endpoints {
+			for i, ipa := range ep.ipAliases {
+				if ipa.IP.Equal(alias.IP) {
+					return rnet, ep, i
+				}
+			}
+		}
+	}
+	return nil, nil, -1
+}
+
+func (driver *driver) SetAlias(alias string, r *admin.AliasRequest) error {
+	// the alias may move between networks
+	unlock := driver.lockAll()
+	defer unlock()
+
+	ipa, err := parseAlias(alias)
+	if err != nil {
+		return err
+	}
+	rnet, err := driver.getNetwork(r.NetworkID)
+	if err != nil {
+		return err
+	}
+	ep, err := driver.getEndpoint(r.NetworkID, r.EndpointID)
+	if err != nil {
+		return err
+	}
+	if _, old, i := driver.findAlias(ipa); old != nil {
+		if old == ep {
+			return nil
+		}
+		driver.removeEndpointAlias(old, i)
+	}
+	ep.ipAliases = append(ep.ipAliases, ipa)
+	// not serving a request, the lines carry no request fields
+	ctx := context.Background()
+	if ep.aliasesRouted {
+		if link, err := netlink.LinkByName(ep.iface); err == nil {
+			routeAdd(ctx, ipa, link)
+			if driver.settings().StaticNeighbors && ep.macAddress != nil {
+				addNeighbors(ctx, ep, link)
+			}
+		}
+		driver.announce(ipa.IP)
+	}
+	log.Infof("Alias %s assigned to %s in %s", ipa, r.EndpointID, rnet.id)
+	return nil
+}
+
+func (driver *driver) RemoveAlias(alias string) error {
+	unlock := driver.lockAll()
+	defer unlock()
+
+	ipa, err := parseAlias(alias)
+	if err != nil {
+		return err
+	}
+	_, ep, i := driver.findAlias(ipa)
+	if ep == nil {
+		return fmt.Errorf("alias %s not found", alias)
+	}
+	driver.removeEndpointAlias(ep, i)
+	log.Infof("Alias %s removed", ipa)
+	return nil
+}
+
+// removeEndpointAlias drops the i-th alias of the endpoint and its route.
+func (driver *driver) removeEndpointAlias(ep *routedEndpoint, i int) {
+	ipa := ep.ipAliases[i]
+	if ep.aliasesRouted {
+		ctx := context.Background()
+		if link, err := netlink.LinkByName(ep.iface); err == nil {
+			routeDel(ctx, ipa, link)
+			if driver.settings().StaticNeighbors {
+				family := netlink.FAMILY_V4
+				if ipa.IP.To4() == nil {
+					family = netlink.FAMILY_V6
+				}
+				netlink.NeighDel(&netlink.Neigh{LinkIndex: link.Attrs().Index, Family: family, IP: ipa.IP})
+			}
+		}
+	}
+	ep.ipAliases = append(ep.ipAliases[:i], ep.ipAliases[i+1:]...)
+}
+
+func (driver *driver) DrainNetwork(networkID string, drain bool) error {
+	rnet, err := driver.lockNetwork(networkID)
+	if err != nil {
+		return err
+	}
+	defer rnet.Unlock()
+	if rnet.draining == drain {
+		return nil
+	}
+	rnet.draining = drain
+	ctx := context.Background()
+	for _, ep := range rnet.endpoints {
+		driver.routeAliases(ctx, rnet, ep)
+	}
+	if err := programVIPs(ctx, rnet); err != nil {
+		log.Errorf("Failed to update service VIPs of %s: %s", networkID, err)
+	}
+	log.Infof("Network %s draining: %t", networkID, drain)
+	return nil
+}
+
+// sortedKeys returns the keys of a map indexed by strings in order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*routedNetwork:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*routedEndpoint:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*routedNode:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*routedPool:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]bool:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if keys == nil {
+		keys = []string{}
+	}
+	return keys
+}
+
+func (driver *driver) Cleanup(dryRun bool) (*admin.CleanupReport, error) {
+	// no join may create a veth while the orphans are listed
+	unlock := driver.lockAll()
+	defer unlock()
+
+	report := &admin.CleanupReport{DryRun: dryRun, Interfaces: []string{}}
+	links, _, err := driver.orphanLinks()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		report.Interfaces = append(report.Interfaces, name)
+		if dryRun {
+			continue
+		}
+		log.Infof("Deleting orphan host interface %s", name)
+		if err := netlinkErr("link_del", netlink.LinkDel(link)); err != nil {
+			return report, fmt.Errorf("unable to delete %s: %s", name, err)
+		}
+	}
+	return report, nil
+}
+
+// linkAliasPrefix starts the alias of the host veths created by the plugin.
+const linkAliasPrefix = "routed:"
+
+// linkAlias is the alias given to the host veth of an endpoint, naming the
+// run of the plugin that created it.
+func (driver *driver) linkAlias(endpointID string) string {
+	return linkAliasPrefix + driver.instance + ":" + endpointID
+}
+
+// orphanLinks returns the host veths created by this run of the plugin that
+// no known endpoint uses, left by a failed join or leave, and those created
+// by a previous run. The plugin does not restore its state on restart, so
+// the latter may still serve live containers and are never cleaned up. It
+// is called with all the locks held.
+func (driver *driver) orphanLinks() (orphans, previous []netlink.Link, err error) {
+	used := make(map[string]bool)
+	for _, rnet := range driver.networks {
+		for _, ep := range rnet.endpoints {
+			if ep.iface != "" {
+				used[ep.iface] = true
+			}
+		}
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, nil, err
+	}
+	own := linkAliasPrefix + driver.instance + ":"
+	for _, link := range links {
+		if link.Type() != "veth" || used[link.Attrs().Name] {
+			continue
+		}
+		alias, err := getLinkAlias(link.Attrs().Index)
+		if err != nil {
+			netlinkFailures.Inc("link_get")
+			continue
+		}
+		switch {
+		case strings.HasPrefix(alias, own):
+			orphans = append(orphans, link)
+		case strings.HasPrefix(alias, linkAliasPrefix):
+			previous = append(previous, link)
+		}
+	}
+	return orphans, previous, nil
+}
+
+func linkNames(links []netlink.Link) string {
+	var names []string
+	for _, link := range links {
+		names = append(names, link.Attrs().Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (driver *driver) Doctor() []admin.Check {
+	unlock := driver.lockAll()
+	defer unlock()
+
+	var checks []admin.Check
+	ctx := context.Background()
+	for _, s := range hostSysctls(driver.settings().IPv6) {
+		check := admin.Check{Name: "sysctl " + s.name, OK: true}
+		if err := checkSysctls(ctx, []sysctl{s}, false); err != nil {
+			check.OK, check.Detail = false, err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	check := admin.Check{Name: "orphan interfaces", OK: true}
+	previousCheck := admin.Check{Name: "interfaces of a previous run", OK: true}
+	if orphans, previous, err := driver.orphanLinks(); err != nil {
+		check.OK, check.Detail = false, err.Error()
+	} else {
+		if len(orphans) > 0 {
+			check.OK, check.Detail = false, linkNames(orphans)+" (run routed cleanup)"
+		}
+		// maybe still used by containers, only reported
+		if len(previous) > 0 {
+			previousCheck.Detail = linkNames(previous)
+		}
+	}
+	checks = append(checks, check, previousCheck)
+
+	for _, nid := range sortedKeys(driver.networks) {
+		rnet := driver.networks[nid]
+		for _, id := range sortedKeys(rnet.endpoints) {
+			ep := rnet.endpoints[id]
+			if ep.iface == "" {
+				continue
+			}
+			check := admin.Check{Name: "endpoint " + shortID(id), OK: true}
+			if _, err := netlink.LinkByName(ep.iface); err != nil {
+				check.OK, check.Detail = false, fmt.Sprintf("host interface %s missing", ep.iface)
+			} else if ep.probe != nil && !ep.probe.isHealthy() {
+				check.OK, check.Detail = false, "unhealthy, aliases withdrawn"
+			}
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+func (driver *driver) Stats() []admin.EndpointStats {
+	stats := []admin.EndpointStats{}
+	driver.eachNetwork(func(rnet *routedNetwork) {
+		for _, id := range sortedKeys(rnet.endpoints) {
+			ep := rnet.endpoints[id]
+			if ep.iface == "" {
+				continue
+			}
+			link, err := netlink.LinkByName(ep.iface)
+			if err != nil {
+				netlinkFailures.Inc("link_get")
+				continue
+			}
+			ls, err := getLinkStats(link.Attrs().Index)
+			if err != nil {
+				netlinkFailures.Inc("link_stats")
+				log.Warnf("Unable to read the statistics of %s: %s", ep.iface, err)
+				continue
+			}
+			stats = append(stats, admin.EndpointStats{
+				NetworkID:     rnet.id,
+				EndpointID:    id,
+				HostInterface: ep.iface,
+				RxBytes:       ls.rxBytes,
+				RxPackets:     ls.rxPackets,
+				TxBytes:       ls.txBytes,
+				TxPackets:     ls.txPackets,
+			})
+		}
+	})
+	return stats
+}
@@ -0,0 +1,38 @@
+package driver
+
+import (
+	"context"
+	ipamApi "github.com/docker/libnetwork/ipams/remote/api"
+	"github.com/jc-m/test-docker-plugin/routed/admin"
+	"testing"
+)
+
+func TestReserveAddress(t *testing.T) {
+	d := newTestDriver(t)
+	pool, err := d.RequestPool(context.Background(), &ipamApi.RequestPoolRequest{AddressSpace: DefaultLocalAddressSpace, Pool: "10.99.0.0/29"})
+	if err != nil {
+		t.Fatalf("RequestPool: %s", err)
+	}
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{address: "10.99.0.2"},
+		{address: "10.99.0.6"},
+		// already allocated
+		{address: "10.99.0.2", wantErr: true},
+		// the gateway
+		{address: "10.99.0.1", wantErr: true},
+		// the network and broadcast addresses
+		{address: "10.99.0.0", wantErr: true},
+		{address: "10.99.0.7", wantErr: true},
+		{address: "10.99.1.2", wantErr: true},
+		{address: "2001:db8::2", wantErr: true},
+	}
+	for _, tt := range tests {
+		_, err := d.ReserveAddress(pool.PoolID, &admin.ReserveRequest{Address: tt.address})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.address, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Reconfigure applies the settings of config that can change while
+// networks exist: they take effect for the endpoints joined and the ports
+// published afterwards. The other changed settings are ignored and an
+// error explaining why is returned for each.
+func (driver *driver) Reconfigure(config *Config) []error {
+	driver.configMu.Lock()
+	defer driver.configMu.Unlock()
+
+	c := config.withDefaults()
+	if err := c.validate(); err != nil {
+		return []error{err}
+	}
+	old := driver.config
+	var rejected []error
+	if c.Pool != old.Pool || c.Gateway != old.Gateway {
+		rejected = append(rejected, fmt.Errorf("pool %s gateway %s kept: addresses are allocated from it, restart to change it",
+			old.Pool, old.Gateway))
+		c.Pool, c.Gateway = old.Pool, old.Gateway
+	}
+	if c.LocalAddressSpace != old.LocalAddressSpace || c.GlobalAddressSpace != old.GlobalAddressSpace {
+		rejected = append(rejected, fmt.Errorf("address spaces %s/%s kept: existing networks refer to them, restart to change them",
+			old.LocalAddressSpace, old.GlobalAddressSpace))
+		c.LocalAddressSpace, c.GlobalAddressSpace = old.LocalAddressSpace, old.GlobalAddressSpace
+	}
+	if c.InterfacePrefix != old.InterfacePrefix {
+		rejected = append(rejected, fmt.Errorf("interface prefix %s kept: joined endpoints use it, restart to change it",
+			old.InterfacePrefix))
+		c.InterfacePrefix = old.InterfacePrefix
+	}
+	if c.IPv6 != old.IPv6 || c.FixSysctls != old.FixSysctls {
+		rejected = append(rejected, fmt.Errorf("sysctl settings kept: host sysctls are checked at startup, restart to change them"))
+		c.IPv6, c.FixSysctls = old.IPv6, old.FixSysctls
+	}
+	driver.config = c
+	log.Infof("Reconfigured driver: %+v", *c)
+	return rejected
+}
@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/libnetwork/discoverapi"
+	netApi "github.com/docker/libnetwork/drivers/remote/api"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"time"
+)
+
+type routedNode struct {
+	address string
+	self    bool
+	since   time.Time
+}
+
+// ======= Discovery functions
+
+func (driver *driver) DiscoverNew(ctx context.Context, notif *netApi.DiscoveryNotification) error {
+	driver.Lock()
+	defer driver.Unlock()
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Discover new request: %+v", notif)
+	if notif.DiscoveryType != discoverapi.NodeDiscovery {
+		logger.Debugf("Ignoring discovery type %d", notif.DiscoveryType)
+		return nil
+	}
+	data, err := nodeDiscoveryData(notif.DiscoveryData)
+	if err != nil {
+		return err
+	}
+	driver.nodes[data.Address] = &routedNode{
+		address: data.Address,
+		self:    data.Self,
+		since:   time.Now(),
+	}
+	logger.Infof("Node %s joined (self: %t)", data.Address, data.Self)
+	return nil
+}
+
+func (driver *driver) DiscoverDelete(ctx context.Context, notif *netApi.DiscoveryNotification) error {
+	driver.Lock()
+	defer driver.Unlock()
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Discover delete request: %+v", notif)
+	if notif.DiscoveryType != discoverapi.NodeDiscovery {
+		logger.Debugf("Ignoring discovery type %d", notif.DiscoveryType)
+		return nil
+	}
+	data, err := nodeDiscoveryData(notif.DiscoveryData)
+	if err != nil {
+		return err
+	}
+	delete(driver.nodes, data.Address)
+	logger.Infof("Node %s left", data.Address)
+	return nil
+}
+
+// nodeDiscoveryData converts the generic JSON payload of a node discovery
+// notification back into its libnetwork structure.
+func nodeDiscoveryData(raw interface{}) (*discoverapi.NodeDiscoveryData, error) {
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var data discoverapi.NodeDiscoveryData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("invalid node discovery data %+v: %s", raw, err)
+	}
+	if data.Address == "" {
+		return nil, fmt.Errorf("node discovery without address: %+v", raw)
+	}
+	return &data, nil
+}
@@ -1,135 +1,618 @@
 package driver
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 	netApi "github.com/docker/libnetwork/drivers/remote/api"
 	ipamApi "github.com/docker/libnetwork/ipams/remote/api"
+	"github.com/docker/libnetwork/iptables"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/netutils"
+	"github.com/docker/libnetwork/portmapper"
+	"github.com/docker/libnetwork/types"
+	"github.com/jc-m/test-docker-plugin/routed/admin"
 	"github.com/jc-m/test-docker-plugin/routed/server"
 	"github.com/vishvananda/netlink"
-	"math/rand"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// Defaults of the Config settings.
+const (
+	DefaultPool               = "10.46.0.0/16"
+	DefaultGateway            = "10.46.0.1"
+	DefaultLocalAddressSpace  = "Testlocal"
+	DefaultGlobalAddressSpace = "TestRemote"
+	DefaultMTU                = 1500
+	DefaultInterfacePrefix    = "vethr"
+)
+
+// subPoolBits is the prefix length of the pools carved out of Config.Pool
+// for the networks that request no subnet.
+const subPoolBits = 24
+
+// Plugin is the driver as served on the plugin and the admin sockets.
+type Plugin interface {
+	server.Driver
+	admin.Admin
+	Shutdown(removeDatapath bool)
+	Reconfigure(config *Config) []error
+}
+
 type routedEndpoint struct {
 	iface         string
 	macAddress    net.HardwareAddr
 	hostInterface string
 	ipv4Address   *net.IPNet
+	ipv6Address   *net.IPNet
 	ipAliases     []*net.IPNet
+	portBindings  []types.PortBinding
+	portMapping   []types.PortBinding
+	portMapper    *portmapper.PortMapper
+	service       string
+	probe         *healthProbe
+	// aliasesRouted is set while the alias routes are installed
+	aliasesRouted bool
 }
 
+// routedNetwork is guarded by its lock, except for the settings given at
+// creation (id, subnets, internal, peers) which never change.
 type routedNetwork struct {
-	id        string
-	endpoints map[string]*routedEndpoint
+	sync.Mutex
+	id         string
+	subnets    []*net.IPNet
+	endpoints  map[string]*routedEndpoint
+	masquerade *masqueradeConfig
+	internal   bool
+	peers      []string
+	vips       map[string]*serviceVIP
+	// gateway is the link-local gateway of proxy-arp mode
+	gateway net.IP
+	// draining networks take no new endpoint and withdraw their aliases
+	draining bool
+	// removed is set when the network is deleted while a call waits for
+	// its lock
+	removed bool
 }
 
+// routedPool is guarded by its lock, except for id, subnet and gateway
+// which never change.
 type routedPool struct {
+	sync.Mutex
 	id           string
 	subnet       *net.IPNet
 	gateway      *net.IPNet
 	allocatedIPs map[string]bool
+	// ipRange limits the addresses handed out unrequested, the SubPool of
+	// docker network create --ip-range. It is nil for the whole pool.
+	ipRange *net.IPNet
+	// removed is set when the pool is released while a call waits for its
+	// lock
+	removed bool
+}
+
+// Config holds the driver settings chosen at startup.
+type Config struct {
+	// UserlandProxy runs docker-proxy for published ports so that traffic
+	// which never crosses the nat PREROUTING chain, such as connections
+	// from the host itself, still reaches the container.
+	UserlandProxy bool
+	// FixSysctls corrects the host sysctls the datapath depends on
+	// instead of refusing to start, and sets those of the host veths on
+	// join.
+	FixSysctls bool
+	// IPv6 also manages the IPv6 forwarding and proxy_ndp sysctls.
+	IPv6 bool
+	// GARPCount is the number of gratuitous ARP, or unsolicited neighbor
+	// advertisement, rounds sent when addresses move to an endpoint.
+	GARPCount int
+	// StaticNeighbors installs permanent neighbor entries for the endpoint
+	// addresses on the host veths.
+	StaticNeighbors bool
+	// Pool is the subnet handed out by IPAM and Gateway its gateway
+	// address.
+	Pool    string
+	Gateway string
+	// LocalAddressSpace and GlobalAddressSpace name the IPAM default
+	// address spaces.
+	LocalAddressSpace  string
+	GlobalAddressSpace string
+	// MTU of the endpoint veths.
+	MTU int
+	// InterfacePrefix starts the name of the host side of endpoint veths.
+	InterfacePrefix string
+}
+
+// withDefaults returns a copy of config with the unset settings defaulted.
+func (config *Config) withDefaults() *Config {
+	c := *config
+	if c.Pool == "" {
+		c.Pool = DefaultPool
+	}
+	if c.Gateway == "" {
+		c.Gateway = DefaultGateway
+	}
+	if c.LocalAddressSpace == "" {
+		c.LocalAddressSpace = DefaultLocalAddressSpace
+	}
+	if c.GlobalAddressSpace == "" {
+		c.GlobalAddressSpace = DefaultGlobalAddressSpace
+	}
+	if c.MTU == 0 {
+		c.MTU = DefaultMTU
+	}
+	if c.InterfacePrefix == "" {
+		c.InterfacePrefix = DefaultInterfacePrefix
+	}
+	return &c
 }
 
+// validate checks the settings New and Reconfigure cannot apply.
+func (config *Config) validate() error {
+	// the endpoint ID adds 4 characters, IFNAMSIZ leaves room for 15
+	if len(config.InterfacePrefix) > 11 {
+		return fmt.Errorf("interface prefix %q is longer than 11 characters", config.InterfacePrefix)
+	}
+	if config.MTU < 68 {
+		return fmt.Errorf("MTU %d is below the IPv4 minimum of 68", config.MTU)
+	}
+	_, pool, err := net.ParseCIDR(config.Pool)
+	if err != nil || pool.IP.To4() == nil {
+		return fmt.Errorf("pool %s is not an IPv4 subnet", config.Pool)
+	}
+	if !hasHosts(pool) {
+		return fmt.Errorf("pool %s has no host addresses", config.Pool)
+	}
+	return nil
+}
+
+// hasHosts tells whether a subnet has addresses besides its network and
+// broadcast addresses.
+func hasHosts(subnet *net.IPNet) bool {
+	ones, _ := subnet.Mask.Size()
+	return ones <= 30
+}
+
+// driver locking: the driver lock guards the networks, pools and nodes
+// maps and the isolation chain, each network lock its endpoints and their
+// datapath, and each pool lock its allocated addresses. They are taken in
+// that order, networks by ID when a call spans several. The config, nat
+// chain and health probe locks come last and are only held to read or set
+// their fields.
+//
+// Calls on one network take the driver lock only to find it, so that
+// unrelated networks proceed in parallel. Network creation and deletion
+// hold it throughout since they rebuild the isolation rules of all
+// networks.
 type driver struct {
+	sync.Mutex
 	version string
-	network *routedNetwork
-	pool    *routedPool
-	mtu     int
+	// instance tells the host veths of this run from those of a previous
+	// one in their link alias
+	instance string
+	networks map[string]*routedNetwork
+	// space is Config.Pool, the pools are carved out of it, and gateway
+	// Config.Gateway. They never change.
+	space   *net.IPNet
+	gateway net.IP
+	pools   map[string]*routedPool
+	nodes   map[string]*routedNode
+	// isolation is set once the isolation chain is hooked in FORWARD
+	isolation bool
+
+	configMu sync.Mutex
+	// config is replaced as a whole by Reconfigure, never modified
+	config *Config
+
+	natMu    sync.Mutex
+	natChain *iptables.ChainInfo
 }
 
-func New(version string) (server.Driver, error) {
-	network, _ := netlink.ParseIPNet("10.46.0.0/16")
-	gateway, _ := netlink.ParseIPNet("10.46.0.1/32")
-	pool := &routedPool{
-		id:           "myPool",
-		subnet:       network,
-		allocatedIPs: make(map[string]bool),
-		gateway:      gateway,
+func New(version string, config *Config) (Plugin, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
 	}
-	rnet := &routedNetwork{
-		endpoints: make(map[string]*routedEndpoint),
+	// validated, the host bits of the pool are dropped
+	_, network, _ := net.ParseCIDR(config.Pool)
+	gw := net.ParseIP(config.Gateway).To4()
+	if gw == nil || !network.Contains(gw) {
+		return nil, fmt.Errorf("gateway %s is not an address of pool %s", config.Gateway, config.Pool)
+	}
+	if err := checkSysctls(context.Background(), hostSysctls(config.IPv6), config.FixSysctls); err != nil {
+		return nil, err
 	}
-	pool.allocatedIPs[fmt.Sprintf("%s", gateway)] = true
 	return &driver{
-		version: version,
-		pool:    pool,
-		network: rnet,
+		version:  version,
+		instance: strconv.FormatInt(time.Now().UnixNano(), 36),
+		config:   config,
+		space:    network,
+		gateway:  gw,
+		pools:    make(map[string]*routedPool),
+		networks: make(map[string]*routedNetwork),
+		nodes:    make(map[string]*routedNode),
 	}, nil
 }
 
 // ======= Driver functions
 
-func (driver *driver) GetCapabilities() (*netApi.GetCapabilityResponse, error) {
+func (driver *driver) GetCapabilities(ctx context.Context) (*netApi.GetCapabilityResponse, error) {
+	logger := server.Logger(ctx)
+
 	caps := &netApi.GetCapabilityResponse{
 		Scope: "local",
 	}
-	log.Debugf("Get capabilities: responded with %+v", caps)
+	logger.Debugf("Get capabilities: responded with %+v", caps)
 	return caps, nil
 }
 
-func (driver *driver) CreateNetwork(create *netApi.CreateNetworkRequest) error {
-	log.Debugf("Create network request %+v", create)
+func (driver *driver) CreateNetwork(ctx context.Context, create *netApi.CreateNetworkRequest) error {
+	driver.Lock()
+	defer driver.Unlock()
+	logger := server.Logger(ctx)
 
-	driver.network = &routedNetwork{id: create.NetworkID, endpoints: make(map[string]*routedEndpoint)}
-	log.Infof("Create network %s", create.NetworkID)
+	logger.Debugf("Create network request %+v", create)
+
+	if _, ok := driver.networks[create.NetworkID]; ok {
+		return fmt.Errorf("network %s already exists", create.NetworkID)
+	}
+	rnet := &routedNetwork{id: create.NetworkID, endpoints: make(map[string]*routedEndpoint)}
+	for _, data := range create.IPv4Data {
+		if data.Pool != nil {
+			rnet.subnets = append(rnet.subnets, data.Pool)
+		}
+	}
+	opts := networkOptions(create.Options)
+	rnet.internal = isInternal(create.Options)
+	rnet.peers = parsePeers(opts)
+	masq, err := parseMasqueradeOptions(opts)
+	if err != nil {
+		return err
+	}
+	if rnet.vips, err = parseVIPOptions(opts); err != nil {
+		return err
+	}
+	if rnet.gateway, err = parseGatewayOptions(opts); err != nil {
+		return err
+	}
+	if masq != nil && rnet.internal {
+		return fmt.Errorf("%s cannot be used on an internal network", masqueradeOpt)
+	}
+	// iptables tells networks apart by their subnets
+	for _, m := range driver.networks {
+		if !rnet.isPeer(m) && !m.isPeer(rnet) && rnet.overlaps(m) {
+			return fmt.Errorf("network %s overlaps network %s and cannot be isolated from it", create.NetworkID, m.id)
+		}
+	}
+	if err := abandoned(ctx, "network creation"); err != nil {
+		return err
+	}
+	driver.networks[create.NetworkID] = rnet
+	if err := driver.programIsolation(ctx); err != nil {
+		delete(driver.networks, create.NetworkID)
+		return err
+	}
+	if masq != nil {
+		if err := programMasquerade(ctx, rnet, masq, true); err != nil {
+			delete(driver.networks, create.NetworkID)
+			driver.programIsolation(ctx)
+			return err
+		}
+		rnet.masquerade = masq
+	}
+	if err := programVIPs(ctx, rnet); err != nil {
+		logger.Errorf("Failed to program service VIPs of %s: %s", create.NetworkID, err)
+	}
+	logger.Infof("Create network %s", create.NetworkID)
 
 	return nil
 }
 
-func (driver *driver) DeleteNetwork(delete *netApi.DeleteNetworkRequest) error {
-	log.Debugf("Delete network request: %+v", delete)
-	driver.network = nil
-	log.Infof("Destroying network %s", delete.NetworkID)
+func (driver *driver) DeleteNetwork(ctx context.Context, d *netApi.DeleteNetworkRequest) error {
+	driver.Lock()
+	defer driver.Unlock()
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Delete network request: %+v", d)
+	rnet, err := driver.getNetwork(d.NetworkID)
+	if err != nil {
+		return err
+	}
+	rnet.Lock()
+	for _, ep := range rnet.endpoints {
+		if ep.probe != nil {
+			ep.probe.halt()
+		}
+	}
+	removeNetwork(ctx, rnet)
+	rnet.removed = true
+	rnet.Unlock()
+	delete(driver.networks, d.NetworkID)
+	if err := driver.programIsolation(ctx); err != nil {
+		logger.Warnf("Failed to update isolation rules: %s", err)
+	}
+	logger.Infof("Destroying network %s", d.NetworkID)
+	return nil
+}
+
+// removeNetwork removes the iptables rules of a network, except for the
+// isolation rules shared by all networks.
+func removeNetwork(ctx context.Context, rnet *routedNetwork) {
+	logger := server.Logger(ctx)
+	if err := removeVIPs(ctx, rnet); err != nil {
+		logger.Warnf("Failed to remove service VIPs of %s: %s", rnet.id, err)
+	}
+	if rnet.masquerade != nil {
+		if err := programMasquerade(ctx, rnet, rnet.masquerade, false); err != nil {
+			logger.Warnf("Failed to remove masquerade rules of %s: %s", rnet.id, err)
+		}
+	}
+}
+
+// networkOptions returns the driver specific options given with
+// `docker network create -o`.
+func networkOptions(options map[string]interface{}) map[string]string {
+	opts := make(map[string]string)
+	generic, ok := options[netlabel.GenericData].(map[string]interface{})
+	if !ok {
+		return opts
+	}
+	for k, v := range generic {
+		opts[k] = fmt.Sprintf("%v", v)
+	}
+	return opts
+}
+
+// shortID returns the first 12 characters of a docker ID, the whole ID
+// when it is shorter.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// ifaceID is the part of an endpoint ID naming its veths, the whole ID
+// when shorter.
+func ifaceID(id string) string {
+	if len(id) > 4 {
+		return id[:4]
+	}
+	return id
+}
+
+func (driver *driver) getNetwork(id string) (*routedNetwork, error) {
+	rnet, ok := driver.networks[id]
+	if !ok {
+		return nil, fmt.Errorf("network %s not found", id)
+	}
+	return rnet, nil
+}
+
+func (driver *driver) getEndpoint(networkID, endpointID string) (*routedEndpoint, error) {
+	rnet, err := driver.getNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+	return rnet.getEndpoint(endpointID)
+}
+
+func (rnet *routedNetwork) getEndpoint(id string) (*routedEndpoint, error) {
+	ep, ok := rnet.endpoints[id]
+	if !ok {
+		return nil, fmt.Errorf("endpoint %s not found in network %s", id, rnet.id)
+	}
+	return ep, nil
+}
+
+// lockNetwork returns the network with its lock held, the driver lock is
+// released once it is found.
+func (driver *driver) lockNetwork(id string) (*routedNetwork, error) {
+	driver.Lock()
+	rnet, err := driver.getNetwork(id)
+	driver.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	rnet.Lock()
+	if rnet.removed {
+		rnet.Unlock()
+		return nil, fmt.Errorf("network %s not found", id)
+	}
+	return rnet, nil
+}
+
+// eachNetwork calls f for every network in ID order with its lock held,
+// without holding the driver lock.
+func (driver *driver) eachNetwork(f func(rnet *routedNetwork)) {
+	driver.Lock()
+	var networks []*routedNetwork
+	for _, id := range sortedKeys(driver.networks) {
+		networks = append(networks, driver.networks[id])
+	}
+	driver.Unlock()
+	for _, rnet := range networks {
+		func() {
+			rnet.Lock()
+			defer rnet.Unlock()
+			if !rnet.removed {
+				f(rnet)
+			}
+		}()
+	}
+}
+
+// lockAll takes the driver lock and every network lock, for the calls that
+// span networks. It returns the function releasing them.
+func (driver *driver) lockAll() func() {
+	driver.Lock()
+	var networks []*routedNetwork
+	for _, id := range sortedKeys(driver.networks) {
+		rnet := driver.networks[id]
+		rnet.Lock()
+		networks = append(networks, rnet)
+	}
+	return func() {
+		for _, rnet := range networks {
+			rnet.Unlock()
+		}
+		driver.Unlock()
+	}
+}
+
+// settings returns the current config.
+func (driver *driver) settings() *Config {
+	driver.configMu.Lock()
+	defer driver.configMu.Unlock()
+	return driver.config
+}
+
+// abandoned returns an error when the request of ctx was given up, at its
+// deadline or by docker, before step. The netlink and iptables calls cannot
+// be interrupted, so the calls programming the datapath check between their
+// steps and undo what they did.
+func abandoned(ctx context.Context, step string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s abandoned: %s", step, err)
+	}
 	return nil
 }
 
-func (driver *driver) CreateEndpoint(create *netApi.CreateEndpointRequest) (*netApi.CreateEndpointResponse, error) {
-	log.Debugf("Create endpoint request %+v", create)
+func (driver *driver) CreateEndpoint(ctx context.Context, create *netApi.CreateEndpointRequest) (*netApi.CreateEndpointResponse, error) {
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Create endpoint request %+v", create)
 	var aliases []*net.IPNet
 	endID := create.EndpointID
 	reqIface := create.Interface
-	log.Debugf("Requested Interface %+v", reqIface)
-	log.Debugf("IP Aliases: %+v", reqIface.IPAliases)
+	logger.Debugf("Requested Interface %+v", reqIface)
+	logger.Debugf("IP Aliases: %+v", reqIface.IPAliases)
 
 	for _, ipa := range reqIface.IPAliases {
 		ip, _ := netlink.ParseIPNet(ipa)
 		aliases = append(aliases, ip)
 	}
+	rnet, err := driver.lockNetwork(create.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rnet.Unlock()
+	if rnet.draining {
+		return nil, fmt.Errorf("network %s is draining", create.NetworkID)
+	}
+	probe, err := parseProbe(create.Options)
+	if err != nil {
+		return nil, err
+	}
 	addr, _ := netlink.ParseIPNet(reqIface.Address)
+	addrv6, _ := netlink.ParseIPNet(reqIface.AddressIPv6)
+	if probe != nil && addr == nil {
+		return nil, fmt.Errorf("endpoint %s has no IPv4 address to probe", endID)
+	}
 	ep := &routedEndpoint{
 		ipv4Address: addr,
+		ipv6Address: addrv6,
 		ipAliases:   aliases,
+		service:     endpointLabel(create.Options, serviceLabel),
+		probe:       probe,
 	}
-	driver.network.endpoints[endID] = ep
+	mac, generated, err := endpointMAC(reqIface.MacAddress, addr)
+	if err != nil {
+		return nil, err
+	}
+	ep.macAddress = mac
+	resp := &netApi.CreateEndpointResponse{}
+	if generated {
+		// libnetwork refuses a response setting again what it sent in the
+		// request, so the interface only carries what the driver filled in
+		resp.Interface = &netApi.EndpointInterface{MacAddress: mac.String()}
+	}
+	rnet.endpoints[endID] = ep
+
+	logger.Infof("Creating endpoint %s %+v", endID, resp)
+	return resp, nil
+}
 
-	log.Infof("Creating endpoint %s %+v", endID, nil)
-	return nil, nil
+// endpointMAC returns the requested MAC address of an endpoint or, when
+// none is requested, one derived from its IPv4 address so that it is the
+// same every time the address is used.
+func endpointMAC(requested string, addr *net.IPNet) (net.HardwareAddr, bool, error) {
+	if requested != "" {
+		mac, err := net.ParseMAC(requested)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(mac) != 6 || mac[0]&0x01 != 0 {
+			return nil, false, fmt.Errorf("%s is not a unicast ethernet address", requested)
+		}
+		return mac, false, nil
+	}
+	if addr == nil || addr.IP.To4() == nil {
+		return netutils.GenerateRandomMAC(), true, nil
+	}
+	return netutils.GenerateMACFromIP(addr.IP), true, nil
 }
 
-func (driver *driver) DeleteEndpoint(d *netApi.DeleteEndpointRequest) error {
-	log.Debugf("Delete endpoint request: %+v", d)
+func (driver *driver) DeleteEndpoint(ctx context.Context, d *netApi.DeleteEndpointRequest) error {
+	logger := server.Logger(ctx)
 
-	delete(driver.network.endpoints, d.EndpointID)
+	logger.Debugf("Delete endpoint request: %+v", d)
+
+	rnet, err := driver.lockNetwork(d.NetworkID)
+	if err != nil {
+		return err
+	}
+	defer rnet.Unlock()
+	delete(rnet.endpoints, d.EndpointID)
 
-	log.Infof("Deleting endpoint %s", d.EndpointID)
+	logger.Infof("Deleting endpoint %s", d.EndpointID)
 	return nil
 }
 
-func (driver *driver) EndpointInfo(req *netApi.EndpointInfoRequest) (*netApi.EndpointInfoResponse, error) {
-	log.Debugf("Endpoint info request: %+v", req)
+func (driver *driver) EndpointInfo(ctx context.Context, req *netApi.EndpointInfoRequest) (*netApi.EndpointInfoResponse, error) {
+	logger := server.Logger(ctx)
 
-	log.Infof("Endpoint info %s", req.EndpointID)
-	return &netApi.EndpointInfoResponse{Value: map[string]interface{}{}}, nil
+	logger.Debugf("Endpoint info request: %+v", req)
+
+	rnet, err := driver.lockNetwork(req.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rnet.Unlock()
+	ep, err := rnet.getEndpoint(req.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Endpoint info %s", req.EndpointID)
+	return &netApi.EndpointInfoResponse{Value: endpointInfo(ep)}, nil
 }
 
-func (driver *driver) JoinEndpoint(j *netApi.JoinRequest) (*netApi.JoinResponse, error) {
-	log.Debugf("Join endpoint request: %+v", j)
-	log.Debugf("Joining endpoint %s:%s to %s", j.NetworkID, j.EndpointID, j.SandboxKey)
+func (driver *driver) JoinEndpoint(ctx context.Context, j *netApi.JoinRequest) (*netApi.JoinResponse, error) {
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Join endpoint request: %+v", j)
+	logger.Debugf("Joining endpoint %s:%s to %s", j.NetworkID, j.EndpointID, j.SandboxKey)
+
+	rnet, err := driver.lockNetwork(j.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rnet.Unlock()
+	ep, err := rnet.getEndpoint(j.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	config := driver.settings()
 
-	tempName := j.EndpointID[:4]
-	hostName := "vethr" + j.EndpointID[:4]
+	if err := abandoned(ctx, "join"); err != nil {
+		return nil, err
+	}
+
+	tempName := ifaceID(j.EndpointID)
+	hostName := config.InterfacePrefix + ifaceID(j.EndpointID)
 
 	veth := &netlink.Veth{
 		LinkAttrs: netlink.LinkAttrs{
@@ -138,156 +621,489 @@ func (driver *driver) JoinEndpoint(j *netApi.JoinRequest) (*netApi.JoinResponse,
 		},
 		PeerName: tempName,
 	}
-	log.Debugf("Adding link %+v", veth)
-	if err := netlink.LinkAdd(veth); err != nil {
-		log.Errorf("Unable to add link %+v:%+v", veth, err)
+	logger.Debugf("Adding link %+v", veth)
+	if err := netlinkErr("link_add", netlink.LinkAdd(veth)); err != nil {
+		logger.Errorf("Unable to add link %+v:%+v", veth, err)
 		return nil, err
 	}
-	if err := netlink.LinkSetMTU(veth, 1500); err != nil {
-		log.Errorf("Error setting the MTU %s", err)
+	if err := netlinkErr("link_set", netlink.LinkSetMTU(veth, config.MTU)); err != nil {
+		logger.Errorf("Error setting the MTU %s", err)
+	}
+	if err := netlinkErr("link_set", setLinkAlias(hostName, driver.linkAlias(j.EndpointID))); err != nil {
+		logger.Warnf("Unable to set the alias of %s, cleanup will not see it: %s", hostName, err)
 	}
-	log.Debugf("Bringing link up %+v", veth)
-	if err := netlink.LinkSetUp(veth); err != nil {
-		log.Errorf("Unable to bring up %+v: %+v", veth, err)
+	if ep.macAddress != nil {
+		if err := setPeerMAC(tempName, ep.macAddress); err != nil {
+			logger.Errorf("Unable to set MAC address %s on %s: %s", ep.macAddress, tempName, err)
+		}
+	}
+	logger.Debugf("Bringing link up %+v", veth)
+	if err := netlinkErr("link_set", netlink.LinkSetUp(veth)); err != nil {
+		logger.Errorf("Unable to bring up %+v: %+v", veth, err)
+		netlinkErr("link_del", netlink.LinkDel(veth))
 		return nil, err
 	}
-	ep := driver.network.endpoints[j.EndpointID]
-	ep.iface = hostName
+	iface, err := netlink.LinkByName(hostName)
+	if err != nil {
+		logger.Errorf("Unable to find %s: %s", hostName, err)
+		netlinkErr("link_del", netlink.LinkDel(veth))
+		return nil, err
+	}
+	if err := checkSysctls(ctx, interfaceSysctls(rnet, hostName, config.IPv6), config.FixSysctls); err != nil {
+		logger.Errorf("Unable to configure %s: %s", hostName, err)
+	}
+	if ep.ipv4Address != nil {
+		routeAdd(ctx, ep.ipv4Address, iface)
+	}
+	if config.StaticNeighbors && ep.macAddress != nil {
+		addNeighbors(ctx, ep, iface)
+	}
 
-	iface, _ := netlink.LinkByName(hostName)
-	routeAdd(ep.ipv4Address, iface)
+	// the join completes past this check, until then deleting the veth
+	// takes its routes and neighbors along
+	if err := abandoned(ctx, "join"); err != nil {
+		netlinkErr("link_del", netlink.LinkDel(veth))
+		return nil, err
+	}
+	ep.iface = hostName
+	bindings, err := portBindings(j.Options)
+	if err != nil {
+		logger.Warnf("Ignoring port bindings of %s: %s", j.EndpointID, err)
+	}
+	ep.portBindings = bindings
 
-	for _, ipa := range ep.ipAliases {
-		routeAdd(ipa, iface)
+	// the aliases are announced once routed
+	driver.announce(endpointAddresses(ep)...)
+	driver.routeAliases(ctx, rnet, ep)
+	if ep.probe != nil {
+		ep.probe.onChange = func(healthy bool) {
+			rnet.Lock()
+			defer rnet.Unlock()
+			if !rnet.removed {
+				// long after the join, the lines carry no request fields
+				driver.setHealth(context.Background(), rnet, j.EndpointID, ep, healthy)
+			}
+		}
+		ep.probe.start(ep.ipv4Address.IP, hostName)
+	}
+	if ep.service != "" {
+		if err := programVIPs(ctx, rnet); err != nil {
+			logger.Errorf("Failed to add %s to service %s: %s", j.EndpointID, ep.service, err)
+		}
 	}
 	respIface := &netApi.InterfaceName{
 		SrcName:   tempName,
 		DstPrefix: "eth",
 	}
-	sandboxRoute := netApi.StaticRoute{
-		Destination: "0.0.0.0/0",
-		RouteType:   1, // CONNECTED
-		NextHop:     "",
-	}
+	gateway, sandboxRoutes := rnet.sandboxRoutes()
 	resp := &netApi.JoinResponse{
 		InterfaceName:         respIface,
+		Gateway:               gateway,
 		DisableGatewayService: true,
-		StaticRoutes:          []netApi.StaticRoute{sandboxRoute},
+		StaticRoutes:          sandboxRoutes,
 	}
-	log.Infof("Join Request Response %+v", resp)
+	logger.Infof("Join Request Response %+v", resp)
 
 	return resp, nil
 }
 
-func routeAdd(ip *net.IPNet, iface netlink.Link) error {
+func routeAdd(ctx context.Context, ip *net.IPNet, iface netlink.Link) error {
+	logger := server.Logger(ctx)
 	route := netlink.Route{
 		LinkIndex: iface.Attrs().Index,
 		Dst:       ip,
 	}
-	log.Debugf("Adding route %+v", route)
-	if err := netlink.RouteAdd(&route); err != nil {
-		log.Errorf("Unable to add route %+v: %+v", route, err)
+	logger.Debugf("Adding route %+v", route)
+	if err := netlinkErr("route_add", netlink.RouteAdd(&route)); err != nil {
+		logger.Errorf("Unable to add route %+v: %+v", route, err)
 	}
 	return nil
 }
-func (driver *driver) LeaveEndpoint(leave *netApi.LeaveRequest) error {
-	log.Debugf("Leave request: %+v", leave)
-	ep := driver.network.endpoints[leave.EndpointID]
+
+// routeAliases installs the alias routes of a joined endpoint, or withdraws
+// them while the endpoint is unhealthy or its network drained. Installed
+// aliases are announced to the neighbors.
+func (driver *driver) routeAliases(ctx context.Context, rnet *routedNetwork, ep *routedEndpoint) {
+	logger := server.Logger(ctx)
+	want := ep.iface != "" && !rnet.draining && (ep.probe == nil || ep.probe.isHealthy())
+	if want == ep.aliasesRouted {
+		return
+	}
+	link, err := netlink.LinkByName(ep.iface)
+	if err != nil {
+		logger.Errorf("Unable to route aliases to %s: %s", ep.iface, err)
+		return
+	}
+	for _, ipa := range ep.ipAliases {
+		if want {
+			routeAdd(ctx, ipa, link)
+		} else {
+			routeDel(ctx, ipa, link)
+		}
+	}
+	ep.aliasesRouted = want
+	if want {
+		var ips []net.IP
+		for _, ipa := range ep.ipAliases {
+			ips = append(ips, ipa.IP)
+		}
+		driver.announce(ips...)
+	}
+}
+
+func routeDel(ctx context.Context, ip *net.IPNet, iface netlink.Link) error {
+	logger := server.Logger(ctx)
+	route := netlink.Route{
+		LinkIndex: iface.Attrs().Index,
+		Dst:       ip,
+	}
+	logger.Debugf("Deleting route %+v", route)
+	if err := netlinkErr("route_del", netlink.RouteDel(&route)); err != nil {
+		logger.Errorf("Unable to delete route %+v: %+v", route, err)
+	}
+	return nil
+}
+
+func (driver *driver) LeaveEndpoint(ctx context.Context, leave *netApi.LeaveRequest) error {
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Leave request: %+v", leave)
+	rnet, err := driver.lockNetwork(leave.NetworkID)
+	if err != nil {
+		return err
+	}
+	defer rnet.Unlock()
+	ep, err := rnet.getEndpoint(leave.EndpointID)
+	if err != nil {
+		return err
+	}
+	driver.leave(ctx, rnet, leave.EndpointID, ep)
+	logger.Infof("Leaving %s:%s", leave.NetworkID, leave.EndpointID)
+	return nil
+}
+
+// leave removes the datapath of a joined endpoint.
+func (driver *driver) leave(ctx context.Context, rnet *routedNetwork, id string, ep *routedEndpoint) {
+	logger := server.Logger(ctx)
+	if ep.probe != nil {
+		ep.probe.halt()
+	}
+	if err := driver.releasePorts(ep); err != nil {
+		logger.Warnf("Failed to release published ports of %s: %s", id, err)
+	}
 	link, err := netlink.LinkByName(ep.iface)
 	if err == nil {
-		log.Debugf("Deleting host interface %s", ep.iface)
-		netlink.LinkDel(link)
+		if driver.settings().StaticNeighbors && ep.macAddress != nil {
+			delNeighbors(ctx, ep, link)
+		}
+		logger.Debugf("Deleting host interface %s", ep.iface)
+		if err := netlinkErr("link_del", netlink.LinkDel(link)); err != nil {
+			logger.Errorf("Unable to delete %s: %s", ep.iface, err)
+		}
 	} else {
-		log.Debugf("interface %s not found", ep.iface)
+		logger.Debugf("interface %s not found", ep.iface)
+	}
+	ep.iface = ""
+	ep.aliasesRouted = false
+	if ep.service != "" {
+		if err := programVIPs(ctx, rnet); err != nil {
+			logger.Errorf("Failed to remove %s from service %s: %s", id, ep.service, err)
+		}
 	}
-	log.Infof("Leaving %s:%s", leave.NetworkID, leave.EndpointID)
-	return nil
 }
 
-func (driver *driver) GetDefaultAddressSpaces() (*ipamApi.GetAddressSpacesResponse, error) {
+func (driver *driver) GetDefaultAddressSpaces(ctx context.Context) (*ipamApi.GetAddressSpacesResponse, error) {
+	logger := server.Logger(ctx)
+
+	config := driver.settings()
 	spaces := &ipamApi.GetAddressSpacesResponse{
-		LocalDefaultAddressSpace:  "Testlocal",
-		GlobalDefaultAddressSpace: "TestRemote",
+		LocalDefaultAddressSpace:  config.LocalAddressSpace,
+		GlobalDefaultAddressSpace: config.GlobalAddressSpace,
 	}
-	log.Infof("Get default addresse spaces: responded with %+v", spaces)
+	logger.Infof("Get default addresse spaces: responded with %+v", spaces)
 	return spaces, nil
 }
 
 /// IPAM driver
 
-func (driver *driver) GetIPAMCapabilities() (*ipamApi.GetCapabilityResponse, error) {
+func (driver *driver) GetIPAMCapabilities(ctx context.Context) (*ipamApi.GetCapabilityResponse, error) {
+	logger := server.Logger(ctx)
+
 	caps := &ipamApi.GetCapabilityResponse{
 		RequiresMACAddress: false,
 	}
-	log.Debugf("Get capabilities: responded with %+v", caps)
+	logger.Debugf("Get capabilities: responded with %+v", caps)
 	return caps, nil
 }
 
-func (driver *driver) RequestPool(p *ipamApi.RequestPoolRequest) (*ipamApi.RequestPoolResponse, error) {
-	log.Debugf("Pool Request request: %+v", p)
+// RequestPool hands out the requested subnet, or the next free /24 of
+// Config.Pool, so that every network has its own addresses and can be
+// isolated from the others.
+func (driver *driver) RequestPool(ctx context.Context, p *ipamApi.RequestPoolRequest) (*ipamApi.RequestPoolResponse, error) {
+	driver.Lock()
+	defer driver.Unlock()
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Pool Request request: %+v", p)
+	if p.V6 {
+		return nil, fmt.Errorf("no IPv6 pool, use another IPAM driver for IPv6 addresses")
+	}
+	config := driver.settings()
+	if p.AddressSpace != config.LocalAddressSpace && p.AddressSpace != config.GlobalAddressSpace {
+		return nil, fmt.Errorf("unknown address space %s", p.AddressSpace)
+	}
+	if p.SubPool != "" && p.Pool == "" {
+		return nil, fmt.Errorf("sub-pool %s requested without a pool", p.SubPool)
+	}
+
+	var subnet *net.IPNet
+	if p.Pool != "" {
+		var err error
+		if _, subnet, err = net.ParseCIDR(p.Pool); err != nil || subnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 pool %s", p.Pool)
+		}
+		if !hasHosts(subnet) {
+			return nil, fmt.Errorf("pool %s has no host addresses", p.Pool)
+		}
+		if other := driver.overlappingPool(subnet); other != nil {
+			return nil, fmt.Errorf("pool %s overlaps pool %s", subnet, other.subnet)
+		}
+	} else if subnet = driver.freeSubPool(); subnet == nil {
+		return nil, fmt.Errorf("no pool left in %s", driver.space)
+	}
+	rpool := driver.newPool(subnet)
+	if p.SubPool != "" {
+		_, ipRange, err := net.ParseCIDR(p.SubPool)
+		if err != nil || ipRange.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 sub-pool %s", p.SubPool)
+		}
+		poolOnes, _ := subnet.Mask.Size()
+		if ones, _ := ipRange.Mask.Size(); ones < poolOnes || !subnet.Contains(ipRange.IP) {
+			return nil, fmt.Errorf("sub-pool %s is not within pool %s", p.SubPool, subnet)
+		}
+		rpool.ipRange = ipRange
+		if first, last := rpool.allocRange(); first > last {
+			return nil, fmt.Errorf("sub-pool %s has no host addresses of pool %s", p.SubPool, subnet)
+		}
+	}
+	driver.pools[rpool.id] = rpool
 
-	cidr := fmt.Sprintf("%s", driver.pool.subnet)
-	id := driver.pool.id
-	gateway := fmt.Sprintf("%s", driver.pool.gateway)
 	pool := &ipamApi.RequestPoolResponse{
-		PoolID: id,
-		Pool:   cidr,
-		Data:   map[string]string{"com.docker.network.gateway": gateway},
+		PoolID: rpool.id,
+		Pool:   rpool.subnet.String(),
+		Data:   map[string]string{"com.docker.network.gateway": rpool.gateway.String()},
 	}
 
-	log.Infof("Pool Request: responded with %+v", pool)
+	logger.Infof("Pool Request: responded with %+v", pool)
 	return pool, nil
 }
 
-func (driver *driver) RequestAddress(a *ipamApi.RequestAddressRequest) (*ipamApi.RequestAddressResponse, error) {
-	log.Debugf("Address Request request: %+v", a)
+// newPool returns the pool of subnet, identified by the subnet. Its gateway
+// is Config.Gateway when it is a host address of the subnet, the first host
+// address otherwise.
+func (driver *driver) newPool(subnet *net.IPNet) *routedPool {
+	pool := &routedPool{
+		id:     subnet.String(),
+		subnet: subnet,
+	}
+	first, last := pool.hostRange()
+	gw := driver.gateway
+	if i := ipToUint32(gw); !subnet.Contains(gw) || i < first || i > last {
+		gw = uint32ToIP(first)
+	}
+	pool.gateway = &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)}
+	pool.allocatedIPs = map[string]bool{pool.gateway.String(): true}
+	return pool
+}
 
-	if len(a.Address) > 0 {
-		addr := fmt.Sprintf("%s/32", a.Address)
-		if _, ok := driver.pool.allocatedIPs[addr]; ok {
-			return nil, fmt.Errorf("%s already allocated", addr)
+// overlappingPool returns a pool sharing addresses with subnet.
+func (driver *driver) overlappingPool(subnet *net.IPNet) *routedPool {
+	for _, pool := range driver.pools {
+		if pool.subnet.Contains(subnet.IP) || subnet.Contains(pool.subnet.IP) {
+			return pool
 		}
-		resp := &ipamApi.RequestAddressResponse{
-			Address: addr,
+	}
+	return nil
+}
+
+// freeSubPool returns the first /24 of Config.Pool that no pool uses, the
+// whole of Config.Pool when it is smaller.
+func (driver *driver) freeSubPool() *net.IPNet {
+	ones, _ := driver.space.Mask.Size()
+	bits := subPoolBits
+	if ones > bits {
+		bits = ones
+	}
+	base := ipToUint32(driver.space.IP)
+	for i := uint32(0); i < 1<<uint(bits-ones); i++ {
+		subnet := &net.IPNet{
+			IP:   uint32ToIP(base + i<<uint(32-bits)),
+			Mask: net.CIDRMask(bits, 32),
+		}
+		if driver.overlappingPool(subnet) == nil {
+			return subnet
 		}
-		log.Infof("Addresse request response: %+v", resp)
-		return resp, nil
 	}
-again:
-	// just generate a random address
-	rand.Seed(time.Now().UnixNano())
-	ip := driver.pool.subnet.IP.To4()
-	ip[3] = byte(rand.Intn(254))
-	netIP := fmt.Sprintf("%s/32", ip)
-	log.Infof("ip:%s", netIP)
+	return nil
+}
 
-	_, ok := driver.pool.allocatedIPs[netIP]
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(i uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
 
-	if ok {
-		goto again
+// hostRange returns the first and last host addresses of the pool: all
+// its addresses but its network and broadcast addresses.
+func (pool *routedPool) hostRange() (first, last uint32) {
+	network, broadcast := netRange(pool.subnet)
+	return network + 1, broadcast - 1
+}
+
+// allocRange returns the first and last addresses RequestAddress hands out
+// when none is requested: the host addresses within the pool range.
+func (pool *routedPool) allocRange() (first, last uint32) {
+	first, last = pool.hostRange()
+	if pool.ipRange != nil {
+		start, end := netRange(pool.ipRange)
+		if start > first {
+			first = start
+		}
+		if end < last {
+			last = end
+		}
 	}
-	driver.pool.allocatedIPs[netIP] = true
+	return first, last
+}
+
+// netRange returns the first and last addresses of an IPv4 subnet.
+func netRange(subnet *net.IPNet) (first, last uint32) {
+	ones, _ := subnet.Mask.Size()
+	first = ipToUint32(subnet.IP)
+	return first, first | (1<<uint(32-ones) - 1)
+}
+
+// lockPool returns the pool with its lock held, the driver lock is
+// released once it is found.
+func (driver *driver) lockPool(id string) (*routedPool, error) {
+	driver.Lock()
+	pool, ok := driver.pools[id]
+	driver.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("pool %s not found", id)
+	}
+	pool.Lock()
+	if pool.removed {
+		pool.Unlock()
+		return nil, fmt.Errorf("pool %s not found", id)
+	}
+	return pool, nil
+}
+
+// eachPool calls f for every pool in ID order with its lock held, without
+// holding the driver lock.
+func (driver *driver) eachPool(f func(pool *routedPool)) {
+	driver.Lock()
+	var pools []*routedPool
+	for _, id := range sortedKeys(driver.pools) {
+		pools = append(pools, driver.pools[id])
+	}
+	driver.Unlock()
+	for _, pool := range pools {
+		func() {
+			pool.Lock()
+			defer pool.Unlock()
+			if !pool.removed {
+				f(pool)
+			}
+		}()
+	}
+}
+
+func (driver *driver) RequestAddress(ctx context.Context, a *ipamApi.RequestAddressRequest) (*ipamApi.RequestAddressResponse, error) {
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Address Request request: %+v", a)
+	pool, err := driver.lockPool(a.PoolID)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Unlock()
+
+	netIP := ""
+	if len(a.Address) > 0 {
+		first, last := pool.hostRange()
+		ip := net.ParseIP(a.Address).To4()
+		if ip == nil || ipToUint32(ip) < first || ipToUint32(ip) > last {
+			return nil, fmt.Errorf("%s is not a host address of pool %s", a.Address, pool.id)
+		}
+		netIP = fmt.Sprintf("%s/32", ip)
+		if _, ok := pool.allocatedIPs[netIP]; ok {
+			return nil, fmt.Errorf("%s already allocated", netIP)
+		}
+	} else {
+		// the lowest free address, so that a replay gets the same addresses
+		first, last := pool.allocRange()
+		for i := first; i <= last; i++ {
+			if addr := fmt.Sprintf("%s/32", uint32ToIP(i)); !pool.allocatedIPs[addr] {
+				netIP = addr
+				break
+			}
+		}
+		if netIP == "" {
+			return nil, fmt.Errorf("pool %s exhausted", pool.id)
+		}
+		logger.Infof("ip:%s", netIP)
+	}
+	// an address handed out after docker gave up would never be released
+	if err := abandoned(ctx, "address request"); err != nil {
+		return nil, err
+	}
+	pool.allocatedIPs[netIP] = true
 	resp := &ipamApi.RequestAddressResponse{
 		Address: fmt.Sprintf("%s", netIP),
 	}
 
-	log.Infof("Addresse request response: %+v", resp)
+	logger.Infof("Addresse request response: %+v", resp)
 	return resp, nil
 }
 
-func (driver *driver) ReleaseAddress(a *ipamApi.ReleaseAddressRequest) error {
-	log.Debugf("Address Release request: %+v", a)
+func (driver *driver) ReleaseAddress(ctx context.Context, a *ipamApi.ReleaseAddressRequest) error {
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Address Release request: %+v", a)
+	pool, err := driver.lockPool(a.PoolID)
+	if err != nil {
+		return err
+	}
+	defer pool.Unlock()
 	ip := fmt.Sprintf("%s/32", a.Address)
 
-	delete(driver.pool.allocatedIPs, ip)
+	delete(pool.allocatedIPs, ip)
 
-	log.Infof("Addresse release %s from %s", a.Address, a.PoolID)
+	logger.Infof("Addresse release %s from %s", a.Address, a.PoolID)
 	return nil
 }
 
-func (driver *driver) ReleasePool(p *ipamApi.ReleasePoolRequest) error {
-	log.Debugf("Pool Release request: %+v", p)
+func (driver *driver) ReleasePool(ctx context.Context, p *ipamApi.ReleasePoolRequest) error {
+	driver.Lock()
+	defer driver.Unlock()
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Pool Release request: %+v", p)
+	pool, ok := driver.pools[p.PoolID]
+	if !ok {
+		return fmt.Errorf("pool %s not found", p.PoolID)
+	}
+	pool.Lock()
+	pool.removed = true
+	pool.Unlock()
+	delete(driver.pools, p.PoolID)
 
-	log.Infof("Pool release %s ", p.PoolID)
+	logger.Infof("Pool release %s ", p.PoolID)
 	return nil
 }
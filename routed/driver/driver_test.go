@@ -0,0 +1,394 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/driverapi"
+	netApi "github.com/docker/libnetwork/drivers/remote/api"
+	ipamApi "github.com/docker/libnetwork/ipams/remote/api"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// set in the environment of the tests re-executed in their own network
+// namespace
+const testNetnsEnv = "ROUTED_TEST_NETNS"
+
+// TestMain runs the tests again in a new network namespace, so that the
+// veths, routes and sysctls they program vanish with it.
+func TestMain(m *testing.M) {
+	if os.Getenv(testNetnsEnv) != "" {
+		os.Exit(m.Run())
+	}
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), testNetnsEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if os.Getuid() != 0 {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	}
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			os.Exit(exit.Sys().(syscall.WaitStatus).ExitStatus())
+		}
+		// no network namespace, the tests needing one skip
+		fmt.Fprintf(os.Stderr, "unable to run in a network namespace: %s\n", err)
+		os.Exit(m.Run())
+	}
+	os.Exit(0)
+}
+
+func newTestDriver(t *testing.T) *driver {
+	if os.Getenv(testNetnsEnv) == "" {
+		t.Skip("needs a network namespace")
+	}
+	log.SetLevel(log.ErrorLevel)
+	p, err := New("1", &Config{FixSysctls: true, GARPCount: 1})
+	if err != nil {
+		t.Fatalf("unable to create driver: %s", err)
+	}
+	return p.(*driver)
+}
+
+// createNetwork creates a network on a pool of the routed IPAM and returns
+// the pool ID.
+func createNetwork(t *testing.T, d *driver, id string) string {
+	ctx := context.Background()
+	pool, err := d.RequestPool(ctx, &ipamApi.RequestPoolRequest{AddressSpace: DefaultLocalAddressSpace})
+	if err != nil {
+		t.Fatalf("RequestPool: %s", err)
+	}
+	_, subnet, _ := net.ParseCIDR(pool.Pool)
+	err = d.CreateNetwork(ctx, &netApi.CreateNetworkRequest{
+		NetworkID: id,
+		IPv4Data:  []driverapi.IPAMData{{AddressSpace: DefaultLocalAddressSpace, Pool: subnet}},
+	})
+	if err != nil {
+		t.Fatalf("CreateNetwork %s: %s", id, err)
+	}
+	return pool.PoolID
+}
+
+func TestRequestPool(t *testing.T) {
+	d := newTestDriver(t)
+	ctx := context.Background()
+	tests := []struct {
+		name          string
+		req           ipamApi.RequestPoolRequest
+		wantPool      string
+		wantAddresses []string
+		wantErr       bool
+	}{
+		{name: "next /24", req: ipamApi.RequestPoolRequest{}, wantPool: "10.46.0.0/24", wantAddresses: []string{"10.46.0.2/32"}},
+		{name: "another /24", req: ipamApi.RequestPoolRequest{}, wantPool: "10.46.1.0/24"},
+		{
+			name:          "sub-pool",
+			req:           ipamApi.RequestPoolRequest{Pool: "10.90.0.0/24", SubPool: "10.90.0.128/30"},
+			wantPool:      "10.90.0.0/24",
+			wantAddresses: []string{"10.90.0.128/32", "10.90.0.129/32", "10.90.0.130/32", "10.90.0.131/32"},
+		},
+		{name: "overlap", req: ipamApi.RequestPoolRequest{Pool: "10.46.0.0/16"}, wantErr: true},
+		{name: "IPv6", req: ipamApi.RequestPoolRequest{V6: true}, wantErr: true},
+		{name: "unknown address space", req: ipamApi.RequestPoolRequest{AddressSpace: "other"}, wantErr: true},
+		{name: "no host", req: ipamApi.RequestPoolRequest{Pool: "10.91.0.0/31"}, wantErr: true},
+		{name: "sub-pool without pool", req: ipamApi.RequestPoolRequest{SubPool: "10.92.0.0/28"}, wantErr: true},
+		{name: "sub-pool outside", req: ipamApi.RequestPoolRequest{Pool: "10.93.0.0/24", SubPool: "10.94.0.0/28"}, wantErr: true},
+		{name: "sub-pool larger", req: ipamApi.RequestPoolRequest{Pool: "10.95.0.0/24", SubPool: "10.95.0.0/16"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if tt.req.AddressSpace == "" {
+			tt.req.AddressSpace = DefaultLocalAddressSpace
+		}
+		pool, err := d.RequestPool(ctx, &tt.req)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if pool.Pool != tt.wantPool {
+			t.Errorf("%s: got pool %s, want %s", tt.name, pool.Pool, tt.wantPool)
+		}
+		for _, want := range tt.wantAddresses {
+			addr, err := d.RequestAddress(ctx, &ipamApi.RequestAddressRequest{PoolID: pool.PoolID})
+			if err != nil || addr.Address != want {
+				t.Errorf("%s: got address %+v (%v), want %s", tt.name, addr, err, want)
+			}
+		}
+	}
+}
+
+func TestRequestAddressExplicit(t *testing.T) {
+	d := newTestDriver(t)
+	ctx := context.Background()
+	pool, err := d.RequestPool(ctx, &ipamApi.RequestPoolRequest{AddressSpace: DefaultLocalAddressSpace, Pool: "10.99.0.0/30"})
+	if err != nil {
+		t.Fatalf("RequestPool: %s", err)
+	}
+	// the gateway takes .1
+	addr, err := d.RequestAddress(ctx, &ipamApi.RequestAddressRequest{PoolID: pool.PoolID, Address: "10.99.0.2"})
+	if err != nil {
+		t.Fatalf("RequestAddress 10.99.0.2: %s", err)
+	}
+	if addr.Address != "10.99.0.2/32" {
+		t.Errorf("got %s, want 10.99.0.2/32", addr.Address)
+	}
+	if _, err := d.RequestAddress(ctx, &ipamApi.RequestAddressRequest{PoolID: pool.PoolID}); err == nil {
+		t.Errorf("an explicitly requested address was handed out again")
+	}
+	for _, a := range []string{"10.99.0.2", "10.99.0.3", "10.98.0.2"} {
+		if _, err := d.RequestAddress(ctx, &ipamApi.RequestAddressRequest{PoolID: pool.PoolID, Address: a}); err == nil {
+			t.Errorf("%s was handed out", a)
+		}
+	}
+}
+
+func TestEndpointMAC(t *testing.T) {
+	_, ipv4, _ := net.ParseCIDR("10.46.0.2/32")
+	_, ipv6, _ := net.ParseCIDR("2001:db8::2/128")
+	tests := []struct {
+		name          string
+		requested     string
+		addr          *net.IPNet
+		want          string
+		wantGenerated bool
+		wantErr       bool
+	}{
+		{name: "requested", requested: "02:00:00:00:00:01", addr: ipv4, want: "02:00:00:00:00:01"},
+		{name: "from IPv4", addr: ipv4, want: "02:42:0a:2e:00:02", wantGenerated: true},
+		{name: "random", addr: ipv6, wantGenerated: true},
+		{name: "no address", wantGenerated: true},
+		{name: "invalid", requested: "02:00:00:00:00", wantErr: true},
+		{name: "multicast", requested: "01:00:5e:00:00:01", wantErr: true},
+		{name: "EUI-64", requested: "02:00:00:00:00:00:00:01", wantErr: true},
+	}
+	for _, tt := range tests {
+		mac, generated, err := endpointMAC(tt.requested, tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if generated != tt.wantGenerated {
+			t.Errorf("%s: generated %t, want %t", tt.name, generated, tt.wantGenerated)
+		}
+		if tt.want != "" && mac.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, mac, tt.want)
+		}
+		if len(mac) != 6 || mac[0]&0x01 != 0 || mac[0]&0x02 == 0 {
+			t.Errorf("%s: %s is not a locally administered unicast address", tt.name, mac)
+		}
+	}
+}
+
+func TestProbeLifecycle(t *testing.T) {
+	d := newTestDriver(t)
+	ctx := context.Background()
+	createNetwork(t, d, "probed-0123456789")
+	labels := map[string]interface{}{probeLabel: "icmp", probeIntervalLabel: "1h"}
+	_, err := d.CreateEndpoint(ctx, &netApi.CreateEndpointRequest{
+		NetworkID:  "probed-0123456789",
+		EndpointID: "ipv6-endpoint",
+		Interface:  &netApi.EndpointInterface{AddressIPv6: "2001:db8::2/128"},
+		Options:    labels,
+	})
+	if err == nil {
+		t.Errorf("an endpoint without IPv4 address was probed")
+	}
+	_, err = d.CreateEndpoint(ctx, &netApi.CreateEndpointRequest{
+		NetworkID:  "probed-0123456789",
+		EndpointID: "beef-endpoint",
+		Interface:  &netApi.EndpointInterface{Address: "10.46.0.2/32"},
+		Options:    labels,
+	})
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %s", err)
+	}
+	if _, err := d.JoinEndpoint(ctx, &netApi.JoinRequest{NetworkID: "probed-0123456789", EndpointID: "beef-endpoint", SandboxKey: "x"}); err != nil {
+		t.Fatalf("Join: %s", err)
+	}
+	probe := d.networks["probed-0123456789"].endpoints["beef-endpoint"].probe
+	if err := d.DeleteNetwork(ctx, &netApi.DeleteNetworkRequest{NetworkID: "probed-0123456789"}); err != nil {
+		t.Fatalf("DeleteNetwork: %s", err)
+	}
+	probe.Lock()
+	defer probe.Unlock()
+	if probe.stop != nil {
+		t.Errorf("the probe still runs after the network was deleted")
+	}
+}
+
+// cancelAfter is a context canceled once its Err was checked checks times,
+// to stop a call part-way.
+type cancelAfter struct {
+	context.Context
+	checks int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.checks == 0 {
+		return context.Canceled
+	}
+	c.checks--
+	return nil
+}
+
+func TestAbandoned(t *testing.T) {
+	d := newTestDriver(t)
+	poolID := createNetwork(t, d, "abandon-0123456789")
+
+	if _, err := d.RequestAddress(&cancelAfter{Context: context.Background()}, &ipamApi.RequestAddressRequest{PoolID: poolID}); err == nil {
+		t.Fatalf("an abandoned address request succeeded")
+	}
+	addr, err := d.RequestAddress(context.Background(), &ipamApi.RequestAddressRequest{PoolID: poolID})
+	if err != nil {
+		t.Fatalf("RequestAddress: %s", err)
+	}
+	if addr.Address != "10.46.0.2/32" {
+		t.Errorf("got %s, the abandoned request kept 10.46.0.2", addr.Address)
+	}
+
+	_, err = d.CreateEndpoint(context.Background(), &netApi.CreateEndpointRequest{
+		NetworkID:  "abandon-0123456789",
+		EndpointID: "feed-endpoint",
+		Interface:  &netApi.EndpointInterface{Address: addr.Address},
+	})
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %s", err)
+	}
+	join := &netApi.JoinRequest{NetworkID: "abandon-0123456789", EndpointID: "feed-endpoint", SandboxKey: "x"}
+	// canceled once the veth is programmed
+	if _, err := d.JoinEndpoint(&cancelAfter{Context: context.Background(), checks: 1}, join); err == nil {
+		t.Fatalf("an abandoned join succeeded")
+	}
+	if ep := d.networks["abandon-0123456789"].endpoints["feed-endpoint"]; ep.iface != "" {
+		t.Errorf("the abandoned join left the endpoint joined on %s", ep.iface)
+	}
+	if _, err := netlink.LinkByName(d.settings().InterfacePrefix + "feed"); err == nil {
+		t.Errorf("the abandoned join left its veth")
+	}
+	if _, err := d.JoinEndpoint(context.Background(), join); err != nil {
+		t.Errorf("Join after the abandoned one: %s", err)
+	}
+}
+
+// TestParallel runs endpoints through their lifecycle on several networks
+// at once, while the admin calls walk all of them. Run it with -race.
+func TestParallel(t *testing.T) {
+	// the networks are isolated from each other
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("needs iptables")
+	}
+	d := newTestDriver(t)
+	ctx := context.Background()
+	const networks, endpoints, rounds = 4, 6, 5
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		used = map[string]string{}
+		errs = make(chan error, networks*endpoints)
+	)
+	for n := 0; n < networks; n++ {
+		nid := fmt.Sprintf("net%d-0123456789", n)
+		poolID := createNetwork(t, d, nid)
+		for e := 0; e < endpoints; e++ {
+			// the veth names take the first 4 characters of the ID
+			eid := fmt.Sprintf("%x%x00-endpoint", n, e)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- lifecycle(ctx, d, nid, eid, poolID, rounds, func(addr string, take bool) error {
+					mu.Lock()
+					defer mu.Unlock()
+					if !take {
+						delete(used, addr)
+						return nil
+					}
+					if other, ok := used[addr]; ok {
+						return fmt.Errorf("%s handed out to %s and %s", addr, other, eid)
+					}
+					used[addr] = eid
+					return nil
+				})
+			}()
+		}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			d.Networks()
+			d.Endpoints()
+			d.Pools()
+			d.Allocations()
+			d.Doctor()
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-done
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// lifecycle requests an address, creates, joins, leaves and deletes an
+// endpoint with it and releases it, rounds times. track records the
+// address while it is in use.
+func lifecycle(ctx context.Context, d *driver, nid, eid, poolID string, rounds int, track func(addr string, take bool) error) error {
+	for r := 0; r < rounds; r++ {
+		addr, err := d.RequestAddress(ctx, &ipamApi.RequestAddressRequest{PoolID: poolID})
+		if err != nil {
+			return fmt.Errorf("RequestAddress: %s", err)
+		}
+		if err := track(addr.Address, true); err != nil {
+			return err
+		}
+		_, err = d.CreateEndpoint(ctx, &netApi.CreateEndpointRequest{
+			NetworkID:  nid,
+			EndpointID: eid,
+			Interface:  &netApi.EndpointInterface{Address: addr.Address},
+		})
+		if err != nil {
+			return fmt.Errorf("CreateEndpoint %s: %s", eid, err)
+		}
+		if _, err := d.JoinEndpoint(ctx, &netApi.JoinRequest{NetworkID: nid, EndpointID: eid, SandboxKey: "x"}); err != nil {
+			return fmt.Errorf("Join %s: %s", eid, err)
+		}
+		if err := d.LeaveEndpoint(ctx, &netApi.LeaveRequest{NetworkID: nid, EndpointID: eid}); err != nil {
+			return fmt.Errorf("Leave %s: %s", eid, err)
+		}
+		if err := d.DeleteEndpoint(ctx, &netApi.DeleteEndpointRequest{NetworkID: nid, EndpointID: eid}); err != nil {
+			return fmt.Errorf("DeleteEndpoint %s: %s", eid, err)
+		}
+		track(addr.Address, false)
+		release := &ipamApi.ReleaseAddressRequest{PoolID: poolID, Address: strings.TrimSuffix(addr.Address, "/32")}
+		if err := d.ReleaseAddress(ctx, release); err != nil {
+			return fmt.Errorf("ReleaseAddress: %s", err)
+		}
+	}
+	return nil
+}
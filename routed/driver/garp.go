@@ -0,0 +1,168 @@
+package driver
+
+import (
+	"encoding/binary"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const announceInterval = time.Second
+
+// announce sends gratuitous ARP, or unsolicited neighbor advertisements for
+// IPv6, for the given addresses on the uplinks so that upstream neighbors
+// drop the entries they cached for a previous owner. It runs in the
+// background and repeats config.GARPCount times.
+func (driver *driver) announce(ips ...net.IP) {
+	count := driver.settings().GARPCount
+	if count <= 0 || len(ips) == 0 {
+		return
+	}
+	go func() {
+		for i := 0; i < count; i++ {
+			if i > 0 {
+				time.Sleep(announceInterval)
+			}
+			for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+				for _, link := range uplinks(family) {
+					for _, ip := range ips {
+						if (ip.To4() != nil) != (family == netlink.FAMILY_V4) {
+							continue
+						}
+						var err error
+						if family == netlink.FAMILY_V4 {
+							err = sendGratuitousARP(link, ip)
+						} else {
+							err = sendUnsolicitedNA(link, ip)
+						}
+						if err != nil {
+							log.Warnf("Unable to announce %s on %s: %s", ip, link.Attrs().Name, err)
+						}
+					}
+				}
+			}
+		}
+	}()
+}
+
+// endpointIPs returns the address and the aliases of an endpoint.
+func endpointIPs(ep *routedEndpoint) []net.IP {
+	ips := endpointAddresses(ep)
+	for _, ipa := range ep.ipAliases {
+		ips = append(ips, ipa.IP)
+	}
+	return ips
+}
+
+// endpointAddresses returns the IPv4 and IPv6 addresses of an endpoint,
+// without its aliases.
+func endpointAddresses(ep *routedEndpoint) []net.IP {
+	var ips []net.IP
+	if ep.ipv4Address != nil {
+		ips = append(ips, ep.ipv4Address.IP)
+	}
+	if ep.ipv6Address != nil {
+		ips = append(ips, ep.ipv6Address.IP)
+	}
+	return ips
+}
+
+// uplinks returns the interfaces holding a default route of the family.
+func uplinks(family int) []netlink.Link {
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		log.Warnf("Unable to list routes: %s", err)
+		return nil
+	}
+	var links []netlink.Link
+	seen := make(map[int]bool)
+	for _, r := range routes {
+		if r.Dst != nil || seen[r.LinkIndex] {
+			continue
+		}
+		seen[r.LinkIndex] = true
+		if link, err := netlink.LinkByIndex(r.LinkIndex); err == nil {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+func htons(i uint16) uint16 {
+	return i<<8 | i>>8
+}
+
+// sendGratuitousARP broadcasts an ARP request for ip from ip, carrying the
+// MAC address of the link.
+func sendGratuitousARP(link netlink.Link, ip net.IP) error {
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return fmt.Errorf("no ethernet address")
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	broadcast := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcast...)
+	frame = append(frame, mac...)
+	frame = append(frame, 0x08, 0x06) // ARP
+	frame = append(frame,
+		0x00, 0x01, // ethernet
+		0x08, 0x00, // IPv4
+		6, 4,
+		0x00, 0x01) // request
+	frame = append(frame, mac...)
+	frame = append(frame, ip.To4()...)
+	frame = append(frame, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, ip.To4()...)
+
+	sa := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  link.Attrs().Index,
+		Halen:    6,
+	}
+	copy(sa.Addr[:], broadcast)
+	return syscall.Sendto(fd, frame, 0, sa)
+}
+
+// sendUnsolicitedNA multicasts an overriding neighbor advertisement for ip
+// to all nodes, carrying the MAC address of the link.
+func sendUnsolicitedNA(link netlink.Link, ip net.IP) error {
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return fmt.Errorf("no ethernet address")
+	}
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "icmpv6")
+	defer f.Close()
+	if err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, link.Attrs().Name); err != nil {
+		return err
+	}
+	// neighbor discovery is only accepted with a hop limit of 255
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+
+	msg := make([]byte, 32)
+	msg[0] = 136                                    // neighbor advertisement, the kernel fills the checksum
+	binary.BigEndian.PutUint32(msg[4:], 0x20000000) // override
+	copy(msg[8:24], ip.To16())
+	msg[24] = 2 // target link-layer address option
+	msg[25] = 1
+	copy(msg[26:], mac)
+
+	sa := &syscall.SockaddrInet6{ZoneId: uint32(link.Attrs().Index)}
+	copy(sa.Addr[:], net.IPv6linklocalallnodes)
+	return syscall.Sendto(fd, msg, 0, sa)
+}
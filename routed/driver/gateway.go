@@ -0,0 +1,59 @@
+package driver
+
+import (
+	"fmt"
+	netApi "github.com/docker/libnetwork/drivers/remote/api"
+	"net"
+)
+
+const (
+	// gatewayModeOpt selects how sandboxes reach the host: "connected",
+	// the default, makes every destination on-link while "proxy-arp"
+	// gives them a link-local gateway answered by the host veth.
+	gatewayModeOpt = "routed.gateway.mode"
+	// gatewayAddressOpt overrides the link-local gateway address.
+	gatewayAddressOpt = "routed.gateway.address"
+
+	gatewayModeConnected = "connected"
+	gatewayModeProxyARP  = "proxy-arp"
+)
+
+var defaultLinkLocalGateway = net.IPv4(169, 254, 1, 1)
+
+func parseGatewayOptions(opts map[string]string) (net.IP, error) {
+	mode, ok := opts[gatewayModeOpt]
+	if !ok || mode == gatewayModeConnected {
+		if _, ok := opts[gatewayAddressOpt]; ok {
+			return nil, fmt.Errorf("%s requires %s=%s", gatewayAddressOpt, gatewayModeOpt, gatewayModeProxyARP)
+		}
+		return nil, nil
+	}
+	if mode != gatewayModeProxyARP {
+		return nil, fmt.Errorf("invalid value %q for %s", mode, gatewayModeOpt)
+	}
+	gw := defaultLinkLocalGateway
+	if addr, ok := opts[gatewayAddressOpt]; ok {
+		if gw = net.ParseIP(addr).To4(); gw == nil || !gw.IsLinkLocalUnicast() {
+			return nil, fmt.Errorf("invalid link-local address %q for %s", addr, gatewayAddressOpt)
+		}
+	}
+	return gw, nil
+}
+
+// sandboxRoutes returns the gateway and the static routes handed to the
+// sandbox. Without a gateway every destination is on-link; with one only
+// the gateway is, and the host answers for it with proxy ARP.
+func (rnet *routedNetwork) sandboxRoutes() (string, []netApi.StaticRoute) {
+	if rnet.gateway == nil {
+		return "", []netApi.StaticRoute{{
+			Destination: "0.0.0.0/0",
+			RouteType:   1, // CONNECTED
+			NextHop:     "",
+		}}
+	}
+	return rnet.gateway.String(), []netApi.StaticRoute{{
+		Destination: rnet.gateway.String() + "/32",
+		RouteType:   1, // CONNECTED
+		NextHop:     "",
+	}}
+}
@@ -0,0 +1,61 @@
+package driver
+
+import (
+	netApi "github.com/docker/libnetwork/drivers/remote/api"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseGatewayOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    map[string]string
+		want    net.IP
+		wantErr bool
+	}{
+		{name: "default", opts: map[string]string{}},
+		{name: "connected", opts: map[string]string{gatewayModeOpt: gatewayModeConnected}},
+		{name: "proxy-arp", opts: map[string]string{gatewayModeOpt: gatewayModeProxyARP}, want: defaultLinkLocalGateway},
+		{
+			name: "proxy-arp address",
+			opts: map[string]string{gatewayModeOpt: gatewayModeProxyARP, gatewayAddressOpt: "169.254.0.1"},
+			want: net.ParseIP("169.254.0.1"),
+		},
+		{name: "address without proxy-arp", opts: map[string]string{gatewayAddressOpt: "169.254.0.1"}, wantErr: true},
+		{name: "unknown mode", opts: map[string]string{gatewayModeOpt: "bridge"}, wantErr: true},
+		{
+			name:    "not link-local",
+			opts:    map[string]string{gatewayModeOpt: gatewayModeProxyARP, gatewayAddressOpt: "10.0.0.1"},
+			wantErr: true,
+		},
+		{
+			name:    "IPv6 address",
+			opts:    map[string]string{gatewayModeOpt: gatewayModeProxyARP, gatewayAddressOpt: "fe80::1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseGatewayOptions(tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSandboxRoutes(t *testing.T) {
+	gateway, routes := (&routedNetwork{}).sandboxRoutes()
+	want := []netApi.StaticRoute{{Destination: "0.0.0.0/0", RouteType: 1}}
+	if gateway != "" || !reflect.DeepEqual(routes, want) {
+		t.Errorf("connected: got %q %+v, want no gateway and %+v", gateway, routes, want)
+	}
+	gateway, routes = (&routedNetwork{gateway: defaultLinkLocalGateway}).sandboxRoutes()
+	want = []netApi.StaticRoute{{Destination: "169.254.1.1/32", RouteType: 1}}
+	if gateway != "169.254.1.1" || !reflect.DeepEqual(routes, want) {
+		t.Errorf("proxy-arp: got %q %+v, want 169.254.1.1 and %+v", gateway, routes, want)
+	}
+}
@@ -0,0 +1,340 @@
+package driver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Endpoint labels configuring active health probing.
+const (
+	// probeLabel selects the probe: "icmp", "tcp:<port>" or
+	// "http:<port>[/<path>]".
+	probeLabel = netlabel.Prefix + ".routed.probe"
+	// probeIntervalLabel is the delay between probes, 5s by default.
+	probeIntervalLabel = netlabel.Prefix + ".routed.probe.interval"
+	// probeThresholdLabel is the number of consecutive failures, or
+	// successes, needed to change the health state, 3 by default.
+	probeThresholdLabel = netlabel.Prefix + ".routed.probe.threshold"
+
+	defaultProbeInterval  = 5 * time.Second
+	defaultProbeThreshold = 3
+)
+
+type healthProbe struct {
+	kind      string
+	port      int
+	path      string
+	interval  time.Duration
+	threshold int
+
+	// onChange is called from the probe goroutine when the health state
+	// flips.
+	onChange func(healthy bool)
+
+	sync.Mutex
+	// stop ends the probe goroutine, closed by halt
+	stop      chan struct{}
+	healthy   bool
+	failures  int
+	successes int
+	lastError string
+	lastCheck time.Time
+}
+
+// endpointLabel returns an endpoint label given either directly in the
+// endpoint options or among its generic options.
+func endpointLabel(options map[string]interface{}, key string) string {
+	if s, ok := options[key].(string); ok {
+		return s
+	}
+	if generic, ok := options[netlabel.GenericData].(map[string]interface{}); ok {
+		if s, ok := generic[key].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// parseProbe returns the probe configured by the endpoint labels, or nil
+// if the endpoint is not probed.
+func parseProbe(options map[string]interface{}) (*healthProbe, error) {
+	spec := endpointLabel(options, probeLabel)
+	if spec == "" {
+		return nil, nil
+	}
+	p := &healthProbe{
+		interval:  defaultProbeInterval,
+		threshold: defaultProbeThreshold,
+		healthy:   true,
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	p.kind = parts[0]
+	switch p.kind {
+	case "icmp":
+	case "tcp", "http":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("missing port in probe %q", spec)
+		}
+		port := parts[1]
+		if i := strings.Index(port, "/"); i >= 0 && p.kind == "http" {
+			port, p.path = port[:i], port[i:]
+		}
+		var err error
+		if p.port, err = strconv.Atoi(port); err != nil || p.port <= 0 || p.port > 65535 {
+			return nil, fmt.Errorf("invalid port in probe %q", spec)
+		}
+		if p.path == "" {
+			p.path = "/"
+		}
+	default:
+		return nil, fmt.Errorf("unknown probe %q", spec)
+	}
+	if v := endpointLabel(options, probeIntervalLabel); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid probe interval %q", v)
+		}
+		p.interval = d
+	}
+	if v := endpointLabel(options, probeThresholdLabel); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid probe threshold %q", v)
+		}
+		p.threshold = n
+	}
+	return p, nil
+}
+
+// start probes the endpoint address through the host interface until
+// stopped. A probe already running is stopped first.
+func (p *healthProbe) start(ip net.IP, iface string) {
+	stop := make(chan struct{})
+	p.Lock()
+	if p.stop != nil {
+		close(p.stop)
+	}
+	p.stop = stop
+	p.Unlock()
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				p.record(p.check(ip, iface))
+			}
+		}
+	}()
+}
+
+func (p *healthProbe) halt() {
+	p.Lock()
+	defer p.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// record updates the health state with the result of one probe and
+// notifies a change once the threshold is crossed.
+func (p *healthProbe) record(err error) {
+	p.Lock()
+	p.lastCheck = time.Now()
+	changed := false
+	if err != nil {
+		p.lastError = err.Error()
+		p.successes = 0
+		p.failures++
+		if p.healthy && p.failures >= p.threshold {
+			p.healthy = false
+			changed = true
+		}
+	} else {
+		p.lastError = ""
+		p.failures = 0
+		p.successes++
+		if !p.healthy && p.successes >= p.threshold {
+			p.healthy = true
+			changed = true
+		}
+	}
+	healthy := p.healthy
+	p.Unlock()
+
+	if changed && p.onChange != nil {
+		p.onChange(healthy)
+	}
+}
+
+func (p *healthProbe) isHealthy() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.healthy
+}
+
+func (p *healthProbe) check(ip net.IP, iface string) error {
+	timeout := p.interval
+	switch p.kind {
+	case "icmp":
+		return pingICMP(ip, iface, timeout)
+	case "tcp":
+		conn, err := bindToDevice(iface, timeout).Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(p.port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http":
+		client := &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{Dial: bindToDevice(iface, timeout).Dial},
+		}
+		resp, err := client.Get(fmt.Sprintf("http://%s%s", net.JoinHostPort(ip.String(), strconv.Itoa(p.port)), p.path))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("http status %d", resp.StatusCode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown probe %s", p.kind)
+}
+
+// bindToDevice returns a dialer whose sockets leave through the given
+// interface whatever the routing table says.
+func bindToDevice(iface string, timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
+
+// pingICMP sends a single ICMP echo request through the interface and
+// waits for the matching reply.
+func pingICMP(ip net.IP, iface string, timeout time.Duration) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	if err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface); err != nil {
+		return err
+	}
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+
+	id := uint16(os.Getpid())
+	seq := uint16(time.Now().UnixNano())
+	msg := []byte{8, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+
+	sa := &syscall.SockaddrInet4{}
+	copy(sa.Addr[:], ip.To4())
+	if err := syscall.Sendto(fd, msg, 0, sa); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		n, from, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("no echo reply from %s: %s", ip, err)
+		}
+		src, ok := from.(*syscall.SockaddrInet4)
+		if !ok || !net.IP(src.Addr[:]).Equal(ip) || n < 20 {
+			continue
+		}
+		// skip the IP header
+		reply := buf[int(buf[0]&0x0f)*4 : n]
+		if len(reply) >= 8 && reply[0] == 0 &&
+			binary.BigEndian.Uint16(reply[4:]) == id && binary.BigEndian.Uint16(reply[6:]) == seq {
+			return nil
+		}
+	}
+	return fmt.Errorf("no echo reply from %s", ip)
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// healthInfo returns the health state reported in EndpointInfo.
+func (p *healthProbe) healthInfo() map[string]interface{} {
+	p.Lock()
+	defer p.Unlock()
+	status := "healthy"
+	if !p.healthy {
+		status = "unhealthy"
+	}
+	info := map[string]interface{}{
+		infoHealthStatus:   status,
+		infoHealthProbe:    p.kind,
+		infoHealthFailures: p.failures,
+	}
+	if !p.lastCheck.IsZero() {
+		info[infoHealthLastCheck] = p.lastCheck.Format(time.RFC3339)
+	}
+	if p.lastError != "" {
+		info[infoHealthLastError] = p.lastError
+	}
+	return info
+}
+
+// setHealth withdraws the alias routes of an unhealthy endpoint so that
+// traffic for its service addresses stops, and restores them on recovery.
+// The endpoint address stays routed for the probes to go on.
+func (driver *driver) setHealth(ctx context.Context, rnet *routedNetwork, id string, ep *routedEndpoint, healthy bool) {
+	logger := server.Logger(ctx)
+	if healthy {
+		logger.Infof("Endpoint %s is healthy again, restoring aliases", id)
+	} else {
+		logger.Warnf("Endpoint %s is unhealthy, withdrawing aliases", id)
+	}
+	driver.routeAliases(ctx, rnet, ep)
+	if ep.service != "" {
+		if err := programVIPs(ctx, rnet); err != nil {
+			logger.Errorf("Failed to update service %s: %s", ep.service, err)
+		}
+	}
+}
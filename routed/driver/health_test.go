@@ -0,0 +1,91 @@
+package driver
+
+import (
+	"github.com/docker/libnetwork/netlabel"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseProbe(t *testing.T) {
+	probe := func(kind string, port int, path string, interval time.Duration, threshold int) *healthProbe {
+		return &healthProbe{kind: kind, port: port, path: path, interval: interval, threshold: threshold, healthy: true}
+	}
+	tests := []struct {
+		name    string
+		options map[string]interface{}
+		want    *healthProbe
+		wantErr bool
+	}{
+		{name: "not probed", options: map[string]interface{}{}},
+		{
+			name:    "icmp",
+			options: map[string]interface{}{probeLabel: "icmp"},
+			want:    probe("icmp", 0, "", defaultProbeInterval, defaultProbeThreshold),
+		},
+		{
+			name:    "tcp",
+			options: map[string]interface{}{probeLabel: "tcp:5432", probeIntervalLabel: "2s", probeThresholdLabel: "5"},
+			want:    probe("tcp", 5432, "/", 2*time.Second, 5),
+		},
+		{
+			name:    "http generic option",
+			options: map[string]interface{}{netlabel.GenericData: map[string]interface{}{probeLabel: "http:8080/healthz"}},
+			want:    probe("http", 8080, "/healthz", defaultProbeInterval, defaultProbeThreshold),
+		},
+		{name: "http without path", options: map[string]interface{}{probeLabel: "http:80"}, want: probe("http", 80, "/", defaultProbeInterval, defaultProbeThreshold)},
+		{name: "missing port", options: map[string]interface{}{probeLabel: "tcp"}, wantErr: true},
+		{name: "invalid port", options: map[string]interface{}{probeLabel: "tcp:70000"}, wantErr: true},
+		{name: "path on tcp", options: map[string]interface{}{probeLabel: "tcp:80/x"}, wantErr: true},
+		{name: "unknown kind", options: map[string]interface{}{probeLabel: "udp:53"}, wantErr: true},
+		{name: "invalid interval", options: map[string]interface{}{probeLabel: "icmp", probeIntervalLabel: "-1s"}, wantErr: true},
+		{name: "invalid threshold", options: map[string]interface{}{probeLabel: "icmp", probeThresholdLabel: "0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseProbe(tt.options)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestICMPChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want uint16
+	}{
+		{name: "empty", b: nil, want: 0xffff},
+		// the example of RFC 1071
+		{name: "RFC 1071", b: []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, want: 0x220d},
+		{name: "echo request", b: []byte{8, 0, 0, 0, 0, 0, 0, 0}, want: 0xf7ff},
+		{name: "odd length", b: []byte{0x01}, want: 0xfeff},
+		{name: "carry", b: []byte{0xff, 0xff, 0x00, 0x01}, want: 0xfffe},
+	}
+	for _, tt := range tests {
+		if got := icmpChecksum(tt.b); got != tt.want {
+			t.Errorf("%s: got %#04x, want %#04x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProbeRestart(t *testing.T) {
+	p := &healthProbe{kind: "icmp", interval: time.Hour}
+	p.start(net.ParseIP("127.0.0.1"), "lo")
+	first := p.stop
+	p.start(net.ParseIP("127.0.0.1"), "lo")
+	select {
+	case <-first:
+	default:
+		t.Errorf("the first probe still runs")
+	}
+	p.halt()
+	if p.stop != nil {
+		t.Errorf("the probe still runs after halt")
+	}
+}
@@ -0,0 +1,195 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"strings"
+	"syscall"
+)
+
+// Keys of the EndpointOperInfo map. They are part of the plugin interface:
+// scripts parse `docker network inspect` with them, do not rename.
+const (
+	infoHostInterface = "host_interface"
+	infoMacAddress    = "mac_address"
+	infoIPv4Address   = "ipv4_address"
+	infoIPv6Address   = "ipv6_address"
+	infoIPAliases     = "ip_aliases"
+	infoRoutes        = "routes"
+	infoMTU           = "mtu"
+	infoLinkState     = "link_state"
+	// counters of the host veth: rx is what the container sent
+	infoRxBytes   = "rx_bytes"
+	infoRxPackets = "rx_packets"
+	infoRxErrors  = "rx_errors"
+	infoRxDropped = "rx_dropped"
+	infoTxBytes   = "tx_bytes"
+	infoTxPackets = "tx_packets"
+	infoTxErrors  = "tx_errors"
+	infoTxDropped = "tx_dropped"
+
+	infoHealthStatus    = "health_status"
+	infoHealthProbe     = "health_probe"
+	infoHealthFailures  = "health_failures"
+	infoHealthLastCheck = "health_last_check"
+	infoHealthLastError = "health_last_error"
+)
+
+// IFLA_STATS64 is missing from the syscall package
+const iflaStats64 = 23
+
+// operStates names the RFC 2863 operational states of IFLA_OPERSTATE.
+var operStates = []string{"unknown", "notpresent", "down", "lowerlayerdown", "testing", "dormant", "up"}
+
+type linkStats struct {
+	state                string
+	rxPackets, txPackets uint64
+	rxBytes, txBytes     uint64
+	rxErrors, txErrors   uint64
+	rxDropped, txDropped uint64
+}
+
+// getLinkStats reads the operational state and the 64 bit counters of a
+// link, which the vendored netlink does not expose.
+func getLinkStats(index int) (*linkStats, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("unexpected %d messages for link %d", len(msgs), index)
+	}
+	attrs, err := nl.ParseRouteAttr(msgs[0][syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, err
+	}
+	stats := &linkStats{state: operStates[0]}
+	native := nl.NativeEndian()
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.IFLA_OPERSTATE:
+			if len(attr.Value) > 0 && int(attr.Value[0]) < len(operStates) {
+				stats.state = operStates[attr.Value[0]]
+			}
+		case iflaStats64:
+			if len(attr.Value) < 64 {
+				continue
+			}
+			v := func(i int) uint64 { return native.Uint64(attr.Value[i*8:]) }
+			stats.rxPackets, stats.txPackets = v(0), v(1)
+			stats.rxBytes, stats.txBytes = v(2), v(3)
+			stats.rxErrors, stats.txErrors = v(4), v(5)
+			stats.rxDropped, stats.txDropped = v(6), v(7)
+		}
+	}
+	return stats, nil
+}
+
+// setLinkAlias sets the IFLA_IFALIAS of a link, which the vendored netlink
+// cannot set.
+func setLinkAlias(name, alias string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	req := nl.NewNetlinkRequest(syscall.RTM_SETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(syscall.IFLA_IFALIAS, nl.ZeroTerminated(alias)))
+
+	_, err = req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// getLinkAlias returns the IFLA_IFALIAS of a link, empty if it has none.
+func getLinkAlias(index int) (string, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	if err != nil {
+		return "", err
+	}
+	if len(msgs) != 1 {
+		return "", fmt.Errorf("unexpected %d messages for link %d", len(msgs), index)
+	}
+	attrs, err := nl.ParseRouteAttr(msgs[0][syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return "", err
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type == syscall.IFLA_IFALIAS {
+			return strings.TrimRight(string(attr.Value), "\x00"), nil
+		}
+	}
+	return "", nil
+}
+
+// endpointInfo returns the operational data of an endpoint.
+func endpointInfo(ep *routedEndpoint) map[string]interface{} {
+	info := map[string]interface{}{}
+	if ep.macAddress != nil {
+		info[infoMacAddress] = ep.macAddress.String()
+	}
+	if ep.ipv4Address != nil {
+		info[infoIPv4Address] = ep.ipv4Address.String()
+	}
+	if ep.ipv6Address != nil {
+		info[infoIPv6Address] = ep.ipv6Address.String()
+	}
+	aliases := []string{}
+	for _, ipa := range ep.ipAliases {
+		aliases = append(aliases, ipa.String())
+	}
+	info[infoIPAliases] = aliases
+	if ep.probe != nil {
+		for k, v := range ep.probe.healthInfo() {
+			info[k] = v
+		}
+	}
+	if ep.iface == "" {
+		return info
+	}
+
+	info[infoHostInterface] = ep.iface
+	link, err := netlink.LinkByName(ep.iface)
+	if err != nil {
+		info[infoLinkState] = "notpresent"
+		return info
+	}
+	info[infoMTU] = link.Attrs().MTU
+	routes := []string{}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		list, err := netlink.RouteList(link, family)
+		if err != nil {
+			continue
+		}
+		for _, r := range list {
+			if r.Dst != nil {
+				routes = append(routes, r.Dst.String())
+			}
+		}
+	}
+	info[infoRoutes] = routes
+	if stats, err := getLinkStats(link.Attrs().Index); err == nil {
+		info[infoLinkState] = stats.state
+		info[infoRxBytes] = stats.rxBytes
+		info[infoRxPackets] = stats.rxPackets
+		info[infoRxErrors] = stats.rxErrors
+		info[infoRxDropped] = stats.rxDropped
+		info[infoTxBytes] = stats.txBytes
+		info[infoTxPackets] = stats.txPackets
+		info[infoTxErrors] = stats.txErrors
+		info[infoTxDropped] = stats.txDropped
+	}
+	return info
+}
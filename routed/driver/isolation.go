@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/libnetwork/iptables"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"strings"
+)
+
+const (
+	// isolationChain is the filter chain, hooked at the top of FORWARD,
+	// enforcing internal networks and the isolation between networks.
+	isolationChain = "ROUTED-ISOLATION"
+	// peersOpt is a comma separated list of network IDs, or ID prefixes,
+	// whose traffic is allowed to and from the network.
+	peersOpt = "routed.peers"
+)
+
+// isInternal tells whether the network was created with --internal.
+func isInternal(options map[string]interface{}) bool {
+	internal, _ := options[netlabel.Internal].(bool)
+	return internal
+}
+
+func parsePeers(opts map[string]string) []string {
+	var peers []string
+	for _, p := range strings.Split(opts[peersOpt], ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// isPeer tells whether n lists m among its peer networks.
+func (n *routedNetwork) isPeer(m *routedNetwork) bool {
+	for _, p := range n.peers {
+		if strings.HasPrefix(m.id, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps tells whether the two networks share addresses, in which case
+// they cannot be told apart by iptables. CreateNetwork refuses them unless
+// they are peers.
+func (n *routedNetwork) overlaps(m *routedNetwork) bool {
+	for _, a := range n.subnets {
+		for _, b := range m.subnets {
+			if a.Contains(b.IP) || b.Contains(a.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isolationRules returns the filter rules for the current set of networks:
+// internal networks only talk among themselves and networks only talk to
+// each other when one lists the other as a peer.
+func (driver *driver) isolationRules() [][]string {
+	var rules [][]string
+	for _, n := range driver.networks {
+		for _, m := range driver.networks {
+			if n == m || n.isPeer(m) || m.isPeer(n) {
+				continue
+			}
+			for _, src := range n.subnets {
+				for _, dst := range m.subnets {
+					rules = append(rules, []string{"-s", src.String(), "-d", dst.String(), "-j", "DROP"})
+				}
+			}
+		}
+		if !n.internal {
+			continue
+		}
+		for _, subnet := range n.subnets {
+			rules = append(rules,
+				[]string{"-s", subnet.String(), "!", "-d", subnet.String(), "-j", "DROP"},
+				[]string{"!", "-s", subnet.String(), "-d", subnet.String(), "-j", "DROP"})
+		}
+	}
+	return rules
+}
+
+// programIsolation rebuilds the isolation chain from the current set of
+// networks. Nothing is touched until a first rule is needed so that hosts
+// without iptables keep working with a single plain network.
+func (driver *driver) programIsolation(ctx context.Context) error {
+	logger := server.Logger(ctx)
+	rules := driver.isolationRules()
+	if len(rules) == 0 && !driver.isolation {
+		return nil
+	}
+	if _, err := iptables.NewChain(isolationChain, iptables.Filter, false); err != nil {
+		return fmt.Errorf("failed to create filter chain %s: %s", isolationChain, err)
+	}
+	jump := []string{"-j", isolationChain}
+	if !iptables.Exists(iptables.Filter, "FORWARD", jump...) {
+		args := append([]string{string(iptables.Insert), "FORWARD"}, jump...)
+		if output, err := iptables.Raw(args...); err != nil {
+			return err
+		} else if len(output) != 0 {
+			return iptables.ChainError{Chain: "FORWARD", Output: output}
+		}
+	}
+	driver.isolation = true
+
+	if _, err := iptables.Raw("-F", isolationChain); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		args := append([]string{string(iptables.Append), isolationChain}, rule...)
+		if output, err := iptables.Raw(args...); err != nil {
+			return err
+		} else if len(output) != 0 {
+			return iptables.ChainError{Chain: isolationChain, Output: output}
+		}
+	}
+	logger.Debugf("Programmed %d isolation rules", len(rules))
+	return nil
+}
@@ -0,0 +1,123 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/libnetwork/iptables"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Network options controlling outbound NAT, given with
+// `docker network create -o`.
+const (
+	// masqueradeOpt enables SNAT of traffic leaving the network.
+	masqueradeOpt = "routed.masquerade"
+	// masqueradeSourceOpt sets a fixed egress source IP instead of the
+	// address of the outgoing interface.
+	masqueradeSourceOpt = "routed.masquerade.source"
+	// masqueradeExcludeOpt is a comma separated list of destination
+	// prefixes that are reached with the container source address.
+	masqueradeExcludeOpt = "routed.masquerade.exclude"
+)
+
+type masqueradeConfig struct {
+	source  net.IP
+	exclude []*net.IPNet
+}
+
+func parseMasqueradeOptions(opts map[string]string) (*masqueradeConfig, error) {
+	enabled, ok := opts[masqueradeOpt]
+	if !ok {
+		return nil, nil
+	}
+	on, err := strconv.ParseBool(enabled)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q for %s: %s", enabled, masqueradeOpt, err)
+	}
+	if !on {
+		return nil, nil
+	}
+	masq := &masqueradeConfig{}
+	if src, ok := opts[masqueradeSourceOpt]; ok {
+		if masq.source = net.ParseIP(src).To4(); masq.source == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q for %s", src, masqueradeSourceOpt)
+		}
+	}
+	if excl, ok := opts[masqueradeExcludeOpt]; ok {
+		for _, prefix := range strings.Split(excl, ",") {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(prefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid prefix %q for %s: %s", prefix, masqueradeExcludeOpt, err)
+			}
+			masq.exclude = append(masq.exclude, ipNet)
+		}
+	}
+	return masq, nil
+}
+
+// masqueradeChain returns the name of the nat chain holding the outbound
+// NAT rules of the network.
+func masqueradeChain(rnet *routedNetwork) string {
+	return "ROUTED-MASQ-" + shortID(rnet.id)
+}
+
+// programMasquerade installs, or removes when enable is false, a nat
+// chain for the network: destinations inside the network and excluded
+// prefixes return untouched, everything else is masqueraded or SNATed to
+// the configured source.
+func programMasquerade(ctx context.Context, rnet *routedNetwork, masq *masqueradeConfig, enable bool) error {
+	logger := server.Logger(ctx)
+	name := masqueradeChain(rnet)
+	if !enable {
+		for _, subnet := range rnet.subnets {
+			iptables.Raw("-t", string(iptables.Nat), string(iptables.Delete), "POSTROUTING",
+				"-s", subnet.String(), "-j", name)
+		}
+		return iptables.RemoveExistingChain(name, iptables.Nat)
+	}
+
+	if _, err := iptables.NewChain(name, iptables.Nat, false); err != nil {
+		return fmt.Errorf("failed to create nat chain %s: %s", name, err)
+	}
+	// start from an empty chain if it survived a previous run
+	if _, err := iptables.Raw("-t", string(iptables.Nat), "-F", name); err != nil {
+		return err
+	}
+	var rules [][]string
+	for _, subnet := range rnet.subnets {
+		rules = append(rules, []string{"-d", subnet.String(), "-j", "RETURN"})
+	}
+	for _, prefix := range masq.exclude {
+		rules = append(rules, []string{"-d", prefix.String(), "-j", "RETURN"})
+	}
+	if masq.source != nil {
+		rules = append(rules, []string{"-j", "SNAT", "--to-source", masq.source.String()})
+	} else {
+		rules = append(rules, []string{"-j", "MASQUERADE"})
+	}
+	for _, rule := range rules {
+		args := append([]string{"-t", string(iptables.Nat), string(iptables.Append), name}, rule...)
+		if output, err := iptables.Raw(args...); err != nil {
+			return err
+		} else if len(output) != 0 {
+			return iptables.ChainError{Chain: name, Output: output}
+		}
+	}
+	for _, subnet := range rnet.subnets {
+		jump := []string{"-s", subnet.String(), "-j", name}
+		if iptables.Exists(iptables.Nat, "POSTROUTING", jump...) {
+			continue
+		}
+		args := append([]string{"-t", string(iptables.Nat), string(iptables.Append), "POSTROUTING"}, jump...)
+		if output, err := iptables.Raw(args...); err != nil {
+			return err
+		} else if len(output) != 0 {
+			return iptables.ChainError{Chain: "POSTROUTING", Output: output}
+		}
+	}
+	logger.Debugf("Programmed outbound NAT for %s in %s", rnet.id, name)
+	return nil
+}
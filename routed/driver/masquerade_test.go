@@ -0,0 +1,49 @@
+package driver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseMasqueradeOptions(t *testing.T) {
+	cidr := func(s string) *net.IPNet {
+		_, n, _ := net.ParseCIDR(s)
+		return n
+	}
+	tests := []struct {
+		name    string
+		opts    map[string]string
+		want    *masqueradeConfig
+		wantErr bool
+	}{
+		{name: "not set", opts: map[string]string{}},
+		{name: "disabled", opts: map[string]string{masqueradeOpt: "false", masqueradeSourceOpt: "bogus"}},
+		{name: "enabled", opts: map[string]string{masqueradeOpt: "true"}, want: &masqueradeConfig{}},
+		{
+			name: "source and exclusions",
+			opts: map[string]string{
+				masqueradeOpt:        "1",
+				masqueradeSourceOpt:  "192.0.2.1",
+				masqueradeExcludeOpt: "10.0.0.0/8, 172.16.0.0/12",
+			},
+			want: &masqueradeConfig{
+				source:  net.ParseIP("192.0.2.1").To4(),
+				exclude: []*net.IPNet{cidr("10.0.0.0/8"), cidr("172.16.0.0/12")},
+			},
+		},
+		{name: "invalid switch", opts: map[string]string{masqueradeOpt: "maybe"}, wantErr: true},
+		{name: "IPv6 source", opts: map[string]string{masqueradeOpt: "true", masqueradeSourceOpt: "2001:db8::1"}, wantErr: true},
+		{name: "invalid exclusion", opts: map[string]string{masqueradeOpt: "true", masqueradeExcludeOpt: "10.0.0.0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMasqueradeOptions(tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
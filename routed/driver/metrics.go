@@ -0,0 +1,16 @@
+package driver
+
+import (
+	"github.com/jc-m/test-docker-plugin/routed/metrics"
+)
+
+var netlinkFailures = metrics.NewCounterVec("routed_netlink_failures_total",
+	"Failed netlink operations on the datapath.", "op")
+
+// netlinkErr counts a failed netlink operation and returns its error.
+func netlinkErr(op string, err error) error {
+	if err != nil {
+		netlinkFailures.Inc(op)
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package driver
+
+import (
+	"context"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"github.com/vishvananda/netlink"
+	"net"
+)
+
+// endpointNeighbors returns the permanent neighbor entries resolving the
+// endpoint address and aliases to its MAC address on the host veth.
+func endpointNeighbors(ep *routedEndpoint, link netlink.Link) []*netlink.Neigh {
+	var neighs []*netlink.Neigh
+	for _, ip := range endpointIPs(ep) {
+		family := netlink.FAMILY_V4
+		if ip.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		neighs = append(neighs, &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       family,
+			State:        netlink.NUD_PERMANENT,
+			IP:           ip,
+			HardwareAddr: ep.macAddress,
+		})
+	}
+	return neighs
+}
+
+// addNeighbors installs static neighbor entries so that the host never
+// has to ARP for the endpoint.
+func addNeighbors(ctx context.Context, ep *routedEndpoint, link netlink.Link) {
+	logger := server.Logger(ctx)
+	for _, n := range endpointNeighbors(ep, link) {
+		logger.Debugf("Adding neighbor %s on %s", n, link.Attrs().Name)
+		if err := netlinkErr("neigh_add", netlink.NeighSet(n)); err != nil {
+			logger.Errorf("Unable to add neighbor %s: %s", n, err)
+		}
+	}
+}
+
+func delNeighbors(ctx context.Context, ep *routedEndpoint, link netlink.Link) {
+	logger := server.Logger(ctx)
+	for _, n := range endpointNeighbors(ep, link) {
+		logger.Debugf("Deleting neighbor %s on %s", n, link.Attrs().Name)
+		if err := netlinkErr("neigh_del", netlink.NeighDel(n)); err != nil {
+			logger.Errorf("Unable to delete neighbor %s: %s", n, err)
+		}
+	}
+}
+
+// setPeerMAC gives the container side of the veth the endpoint MAC address
+// before it moves into the sandbox.
+func setPeerMAC(name string, mac net.HardwareAddr) error {
+	peer, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlinkErr("link_set", netlink.LinkSetHardwareAddr(peer, mac))
+}
@@ -0,0 +1,242 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/iptables"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/portmapper"
+	"github.com/docker/libnetwork/types"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"net"
+)
+
+const (
+	// routedChain is the iptables chain, in both the nat and the filter
+	// tables, holding the published port rules of all endpoints.
+	routedChain             = "ROUTED"
+	maxAllocatePortAttempts = 10
+)
+
+var defaultBindingIP = net.IPv4(0, 0, 0, 0)
+
+// ======= External connectivity functions
+
+func (driver *driver) ProgramExternalConnectivity(ctx context.Context, p *server.ProgramExternalConnectivityRequest) error {
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Program external connectivity request: %+v", p)
+
+	rnet, err := driver.lockNetwork(p.NetworkID)
+	if err != nil {
+		return err
+	}
+	defer rnet.Unlock()
+	ep, err := rnet.getEndpoint(p.EndpointID)
+	if err != nil {
+		return err
+	}
+	if ep.iface == "" {
+		return fmt.Errorf("endpoint %s has not joined a sandbox", p.EndpointID)
+	}
+	bindings, err := portBindings(p.Options)
+	if err != nil {
+		return err
+	}
+	if bindings != nil {
+		ep.portBindings = bindings
+	}
+	// programming again replaces the published ports
+	if ep.portMapper != nil {
+		if err := driver.releasePorts(ep); err != nil {
+			return err
+		}
+	}
+	if len(ep.portBindings) == 0 {
+		return nil
+	}
+	natChain, err := driver.setupPortMapping()
+	if err != nil {
+		return err
+	}
+	if err := driver.allocatePorts(ctx, ep, natChain); err != nil {
+		return err
+	}
+	logger.Infof("Programmed external connectivity %s: %v", p.EndpointID, ep.portMapping)
+	return nil
+}
+
+func (driver *driver) RevokeExternalConnectivity(ctx context.Context, r *server.RevokeExternalConnectivityRequest) error {
+	logger := server.Logger(ctx)
+
+	logger.Debugf("Revoke external connectivity request: %+v", r)
+
+	rnet, err := driver.lockNetwork(r.NetworkID)
+	if err != nil {
+		return err
+	}
+	defer rnet.Unlock()
+	ep, err := rnet.getEndpoint(r.EndpointID)
+	if err != nil {
+		return err
+	}
+	if err := driver.releasePorts(ep); err != nil {
+		return err
+	}
+	logger.Infof("Revoked external connectivity %s", r.EndpointID)
+	return nil
+}
+
+// setupPortMapping creates the nat and filter chains used for published
+// ports and returns the nat chain. It is done on first use so that the
+// plugin runs on hosts without iptables as long as no port is published.
+func (driver *driver) setupPortMapping() (*iptables.ChainInfo, error) {
+	driver.natMu.Lock()
+	defer driver.natMu.Unlock()
+
+	if driver.natChain != nil {
+		return driver.natChain, nil
+	}
+	natChain, err := iptables.NewChain(routedChain, iptables.Nat, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create nat chain %s: %s", routedChain, err)
+	}
+	if _, err := iptables.NewChain(routedChain, iptables.Filter, false); err != nil {
+		return nil, fmt.Errorf("failed to create filter chain %s: %s", routedChain, err)
+	}
+	if err := iptables.ProgramChain(natChain, "", false, true); err != nil {
+		return nil, err
+	}
+	driver.natChain = natChain
+	return natChain, nil
+}
+
+// allocatePorts maps every requested binding of the endpoint. On failure, or
+// when the request is abandoned, the bindings mapped so far are released.
+func (driver *driver) allocatePorts(ctx context.Context, ep *routedEndpoint, natChain *iptables.ChainInfo) error {
+	if ep.portMapper == nil {
+		ep.portMapper = portmapper.New()
+		ep.portMapper.SetIptablesChain(natChain, ep.iface)
+	}
+	filterChain := &iptables.ChainInfo{Name: routedChain, Table: iptables.Filter}
+	if err := iptables.ProgramChain(filterChain, ep.iface, false, true); err != nil {
+		return err
+	}
+	logger := server.Logger(ctx)
+	userlandProxy := driver.settings().UserlandProxy
+	for _, c := range ep.portBindings {
+		b := c.GetCopy()
+		err := abandoned(ctx, "port publishing")
+		if err == nil {
+			err = allocatePort(logger, ep, &b, userlandProxy)
+		}
+		if err != nil {
+			if cuErr := driver.releasePorts(ep); cuErr != nil {
+				logger.Warnf("Upon allocation failure for %v, failed to clear previously allocated port bindings: %v", b, cuErr)
+			}
+			return err
+		}
+		ep.portMapping = append(ep.portMapping, b)
+	}
+	return nil
+}
+
+func allocatePort(logger *log.Entry, ep *routedEndpoint, bnd *types.PortBinding, userlandProxy bool) error {
+	var (
+		host net.Addr
+		err  error
+	)
+
+	if ep.ipv4Address == nil {
+		return errors.New("port publishing needs an IPv4 address")
+	}
+	bnd.IP = ep.ipv4Address.IP
+	if len(bnd.HostIP) == 0 {
+		bnd.HostIP = defaultBindingIP
+	}
+	if bnd.HostPortEnd == 0 {
+		bnd.HostPortEnd = bnd.HostPort
+	}
+	container, err := bnd.ContainerAddr()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < maxAllocatePortAttempts; i++ {
+		if host, err = ep.portMapper.MapRange(container, bnd.HostIP, int(bnd.HostPort), int(bnd.HostPortEnd), userlandProxy); err == nil {
+			break
+		}
+		// There is no point in retrying an explicitly chosen port.
+		if bnd.HostPort != 0 {
+			logger.Warnf("Failed to allocate and map port %d-%d: %s", bnd.HostPort, bnd.HostPortEnd, err)
+			break
+		}
+		logger.Warnf("Failed to allocate and map port: %s, retry: %d", err, i+1)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch netAddr := host.(type) {
+	case *net.TCPAddr:
+		bnd.HostPort = uint16(netAddr.Port)
+	case *net.UDPAddr:
+		bnd.HostPort = uint16(netAddr.Port)
+	default:
+		return fmt.Errorf("unsupported address type %T", netAddr)
+	}
+	return nil
+}
+
+// releasePorts unmaps all the operational bindings of the endpoint and
+// unhooks its host interface from the filter chain. It does not stop on
+// failure.
+func (driver *driver) releasePorts(ep *routedEndpoint) error {
+	var errorBuf bytes.Buffer
+
+	for _, m := range ep.portMapping {
+		host, err := m.HostAddr()
+		if err == nil {
+			err = ep.portMapper.Unmap(host)
+		}
+		if err != nil {
+			errorBuf.WriteString(fmt.Sprintf("\ncould not release %v because of %v", m, err))
+		}
+	}
+	ep.portMapping = nil
+
+	if ep.portMapper != nil {
+		filterChain := &iptables.ChainInfo{Name: routedChain, Table: iptables.Filter}
+		if err := iptables.ProgramChain(filterChain, ep.iface, false, false); err != nil {
+			errorBuf.WriteString(fmt.Sprintf("\ncould not unlink %s from %s: %v", ep.iface, routedChain, err))
+		}
+		ep.portMapper = nil
+	}
+
+	if errorBuf.Len() != 0 {
+		return errors.New(errorBuf.String())
+	}
+	return nil
+}
+
+// portBindings extracts the published ports from join or external
+// connectivity options. It returns nil if the options carry none.
+func portBindings(options map[string]interface{}) ([]types.PortBinding, error) {
+	raw, ok := options[netlabel.PortMap]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []types.PortBinding
+	if err := json.Unmarshal(b, &bindings); err != nil {
+		return nil, fmt.Errorf("invalid port bindings %+v: %s", raw, err)
+	}
+	return bindings, nil
+}
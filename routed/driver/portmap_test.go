@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/docker/libnetwork/types"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPortBindings(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]interface{}
+		want    []types.PortBinding
+		wantErr bool
+	}{
+		{name: "no options"},
+		{name: "no port map", options: map[string]interface{}{"other": 1}},
+		{name: "null port map", options: map[string]interface{}{netlabel.PortMap: nil}},
+		{
+			name: "decoded JSON",
+			options: map[string]interface{}{netlabel.PortMap: []interface{}{
+				map[string]interface{}{"Proto": 6, "Port": 80, "HostIP": "127.0.0.1", "HostPort": 8080},
+				map[string]interface{}{"Proto": 17, "Port": 53, "HostPort": 5300, "HostPortEnd": 5310},
+			}},
+			want: []types.PortBinding{
+				{Proto: types.TCP, Port: 80, HostIP: net.ParseIP("127.0.0.1"), HostPort: 8080},
+				{Proto: types.UDP, Port: 53, HostPort: 5300, HostPortEnd: 5310},
+			},
+		},
+		{
+			name:    "not a list",
+			options: map[string]interface{}{netlabel.PortMap: "80:8080"},
+			wantErr: true,
+		},
+		{
+			name: "invalid port",
+			options: map[string]interface{}{netlabel.PortMap: []interface{}{
+				map[string]interface{}{"Port": 70000},
+			}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := portBindings(tt.options)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package driver
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libnetwork/iptables"
+)
+
+// Shutdown stops the health probes. With removeDatapath it also removes
+// the host interfaces, routes, published ports and iptables rules of every
+// network, leaving the host as if the plugin never ran. Docker keeps its
+// view of the networks, they have to be recreated.
+func (driver *driver) Shutdown(removeDatapath bool) {
+	unlock := driver.lockAll()
+	defer unlock()
+	// not serving a request, the lines carry no request fields
+	ctx := context.Background()
+
+	for _, nid := range sortedKeys(driver.networks) {
+		rnet := driver.networks[nid]
+		for _, id := range sortedKeys(rnet.endpoints) {
+			ep := rnet.endpoints[id]
+			if !removeDatapath {
+				if ep.probe != nil {
+					ep.probe.halt()
+				}
+				continue
+			}
+			if ep.iface != "" {
+				driver.leave(ctx, rnet, id, ep)
+			}
+		}
+		if removeDatapath {
+			removeNetwork(ctx, rnet)
+		}
+	}
+	if !removeDatapath {
+		return
+	}
+
+	if driver.isolation {
+		iptables.Raw("-D", "FORWARD", "-j", isolationChain)
+		iptables.RemoveExistingChain(isolationChain, iptables.Filter)
+		driver.isolation = false
+	}
+	driver.natMu.Lock()
+	if driver.natChain != nil {
+		driver.natChain.Remove()
+		iptables.RemoveExistingChain(routedChain, iptables.Filter)
+		driver.natChain = nil
+	}
+	driver.natMu.Unlock()
+	log.Infof("Removed the datapath of %d networks", len(driver.networks))
+}
@@ -0,0 +1,112 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// sysctl is a kernel setting the routed datapath depends on.
+type sysctl struct {
+	// name is the dotted sysctl name, e.g. net.ipv4.ip_forward
+	name string
+	// path under /proc/sys, kept apart from name since interface names
+	// may contain dots
+	path string
+	want string
+	// accept lists other values that work as well as want
+	accept []string
+}
+
+func newSysctl(want string, parts ...string) sysctl {
+	return sysctl{
+		name: strings.Join(parts, "."),
+		path: filepath.Join(append([]string{"/proc/sys"}, parts...)...),
+		want: want,
+	}
+}
+
+func (s sysctl) ok(value string) bool {
+	if value == s.want {
+		return true
+	}
+	for _, v := range s.accept {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// hostSysctls returns the global settings checked at startup.
+func hostSysctls(ipv6 bool) []sysctl {
+	list := []sysctl{
+		newSysctl("1", "net", "ipv4", "ip_forward"),
+	}
+	if ipv6 {
+		list = append(list,
+			newSysctl("1", "net", "ipv6", "conf", "all", "forwarding"),
+			newSysctl("1", "net", "ipv6", "conf", "all", "proxy_ndp"))
+	}
+	return list
+}
+
+// interfaceSysctls returns the settings of a host veth of the network.
+func interfaceSysctls(rnet *routedNetwork, iface string, ipv6 bool) []sysctl {
+	rpFilter := newSysctl("1", "net", "ipv4", "conf", iface, "rp_filter")
+	// loose mode still drops sources with no route back at all
+	rpFilter.accept = []string{"2"}
+	list := []sysctl{
+		newSysctl("1", "net", "ipv4", "conf", iface, "forwarding"),
+		rpFilter,
+	}
+	if rnet.gateway != nil {
+		list = append(list,
+			newSysctl("1", "net", "ipv4", "conf", iface, "proxy_arp"),
+			// answer right away instead of after a random delay
+			newSysctl("0", "net", "ipv4", "neigh", iface, "proxy_delay"))
+	}
+	if ipv6 {
+		list = append(list, newSysctl("1", "net", "ipv6", "conf", iface, "forwarding"))
+		if rnet.gateway != nil {
+			list = append(list, newSysctl("1", "net", "ipv6", "conf", iface, "proxy_ndp"))
+		}
+	}
+	return list
+}
+
+// checkSysctls verifies the settings and, when fix is set, corrects the
+// wrong ones. Otherwise the first wrong setting is reported by name.
+func checkSysctls(ctx context.Context, list []sysctl, fix bool) error {
+	logger := server.Logger(ctx)
+	for _, s := range list {
+		b, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", s.name, err)
+		}
+		value := strings.TrimSpace(string(b))
+		if s.ok(value) {
+			continue
+		}
+		if !fix {
+			return fmt.Errorf("%s is %s, it must be set to %s (or run with -fix-sysctls)", s.name, value, s.want)
+		}
+		logger.Infof("Setting %s to %s (was %s)", s.name, s.want, value)
+		if err := writeSysctl(s.path, s.want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSysctl(path, value string) error {
+	log.Debugf("Setting %s to %s", path, value)
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("unable to set %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/libnetwork/iptables"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"github.com/vishvananda/netlink"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	// vipOptPrefix declares a service VIP on the network, as in
+	// `-o routed.vip.web=10.46.255.1`.
+	vipOptPrefix = "routed.vip."
+	// serviceLabel is the endpoint label naming the service an endpoint
+	// is a backend of, as in `--label com.docker.network.routed.service=web`.
+	serviceLabel = netlabel.Prefix + ".routed.service"
+)
+
+type serviceVIP struct {
+	service string
+	ip      net.IP
+	// iface is the host interface the VIP is currently routed to
+	iface string
+}
+
+func parseVIPOptions(opts map[string]string) (map[string]*serviceVIP, error) {
+	vips := make(map[string]*serviceVIP)
+	for k, v := range opts {
+		if !strings.HasPrefix(k, vipOptPrefix) {
+			continue
+		}
+		service := strings.TrimPrefix(k, vipOptPrefix)
+		ip := net.ParseIP(v).To4()
+		if service == "" || ip == nil {
+			return nil, fmt.Errorf("invalid service VIP option %s=%s", k, v)
+		}
+		vips[service] = &serviceVIP{service: service, ip: ip}
+	}
+	return vips, nil
+}
+
+// vipChain returns the name of the nat chain holding the load balancing
+// rules of the network.
+func vipChain(rnet *routedNetwork) string {
+	return "ROUTED-VIP-" + shortID(rnet.id)
+}
+
+// backends returns the joined and healthy IPv4 endpoints of the network
+// carrying the given service, none while the network drains, sorted by
+// endpoint ID so rules are stable across rebuilds.
+func (rnet *routedNetwork) backends(service string) []*routedEndpoint {
+	var ids []string
+	if rnet.draining {
+		return nil
+	}
+	for id, ep := range rnet.endpoints {
+		if ep.service == service && ep.iface != "" && ep.ipv4Address != nil && (ep.probe == nil || ep.probe.isHealthy()) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	eps := make([]*routedEndpoint, 0, len(ids))
+	for _, id := range ids {
+		eps = append(eps, rnet.endpoints[id])
+	}
+	return eps
+}
+
+// programVIPs rebuilds the load balancing chain of the network from its
+// current backends. Each VIP gets one DNAT rule per backend; the statistic
+// match gives every backend the same share of new connections.
+func programVIPs(ctx context.Context, rnet *routedNetwork) error {
+	logger := server.Logger(ctx)
+	if len(rnet.vips) == 0 {
+		return nil
+	}
+	name := vipChain(rnet)
+	if _, err := iptables.NewChain(name, iptables.Nat, false); err != nil {
+		return fmt.Errorf("failed to create nat chain %s: %s", name, err)
+	}
+	for _, hook := range []string{"PREROUTING", "OUTPUT"} {
+		if iptables.Exists(iptables.Nat, hook, "-j", name) {
+			continue
+		}
+		if output, err := iptables.Raw("-t", string(iptables.Nat), string(iptables.Append), hook, "-j", name); err != nil {
+			return err
+		} else if len(output) != 0 {
+			return iptables.ChainError{Chain: hook, Output: output}
+		}
+	}
+	if _, err := iptables.Raw("-t", string(iptables.Nat), "-F", name); err != nil {
+		return err
+	}
+
+	for _, vip := range rnet.vips {
+		backends := rnet.backends(vip.service)
+		for i, ep := range backends {
+			rule := []string{"-t", string(iptables.Nat), string(iptables.Append), name, "-d", vip.ip.String()}
+			if left := len(backends) - i; left > 1 {
+				rule = append(rule, "-m", "statistic", "--mode", "random",
+					"--probability", fmt.Sprintf("%.8f", 1.0/float64(left)))
+			}
+			rule = append(rule, "-j", "DNAT", "--to-destination", ep.ipv4Address.IP.String())
+			if output, err := iptables.Raw(rule...); err != nil {
+				return err
+			} else if len(output) != 0 {
+				return iptables.ChainError{Chain: name, Output: output}
+			}
+		}
+		routeVIP(ctx, vip, backends)
+		logger.Debugf("Service %s VIP %s has %d backends", vip.service, vip.ip, len(backends))
+	}
+	return nil
+}
+
+// routeVIP points the VIP host route at the first backend, the same way
+// aliases are routed, and withdraws it when no backend is left.
+func routeVIP(ctx context.Context, vip *serviceVIP, backends []*routedEndpoint) {
+	logger := server.Logger(ctx)
+	iface := ""
+	if len(backends) > 0 {
+		iface = backends[0].iface
+	}
+	if iface == vip.iface {
+		return
+	}
+	dst := &net.IPNet{IP: vip.ip, Mask: net.CIDRMask(32, 32)}
+	if vip.iface != "" {
+		if link, err := netlink.LinkByName(vip.iface); err == nil {
+			routeDel(ctx, dst, link)
+		}
+	}
+	vip.iface = ""
+	if iface == "" {
+		return
+	}
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		logger.Errorf("Unable to route VIP %s to %s: %s", vip.ip, iface, err)
+		return
+	}
+	routeAdd(ctx, dst, link)
+	vip.iface = iface
+}
+
+// removeVIPs unhooks and deletes the load balancing chain of the network
+// and withdraws the VIP routes.
+func removeVIPs(ctx context.Context, rnet *routedNetwork) error {
+	if len(rnet.vips) == 0 {
+		return nil
+	}
+	for _, vip := range rnet.vips {
+		routeVIP(ctx, vip, nil)
+	}
+	name := vipChain(rnet)
+	for _, hook := range []string{"PREROUTING", "OUTPUT"} {
+		iptables.Raw("-t", string(iptables.Nat), string(iptables.Delete), hook, "-j", name)
+	}
+	return iptables.RemoveExistingChain(name, iptables.Nat)
+}
@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseVIPOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    map[string]string
+		want    map[string]*serviceVIP
+		wantErr bool
+	}{
+		{name: "none", opts: map[string]string{"other": "1"}, want: map[string]*serviceVIP{}},
+		{
+			name: "two services",
+			opts: map[string]string{vipOptPrefix + "web": "10.46.255.1", vipOptPrefix + "db": "10.46.255.2"},
+			want: map[string]*serviceVIP{
+				"web": {service: "web", ip: net.ParseIP("10.46.255.1").To4()},
+				"db":  {service: "db", ip: net.ParseIP("10.46.255.2").To4()},
+			},
+		},
+		{name: "no service", opts: map[string]string{vipOptPrefix: "10.46.255.1"}, wantErr: true},
+		{name: "invalid address", opts: map[string]string{vipOptPrefix + "web": "10.46.255"}, wantErr: true},
+		{name: "IPv6 address", opts: map[string]string{vipOptPrefix + "web": "2001:db8::1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseVIPOptions(tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBackends(t *testing.T) {
+	ipv4 := &net.IPNet{IP: net.ParseIP("10.46.0.2").To4(), Mask: net.CIDRMask(32, 32)}
+	rnet := &routedNetwork{endpoints: map[string]*routedEndpoint{
+		"c": {service: "web", iface: "cali2", ipv4Address: ipv4},
+		"a": {service: "web", iface: "cali1", ipv4Address: ipv4},
+		"b": {service: "web", iface: "cali3"},
+		"d": {service: "web", ipv4Address: ipv4},
+		"e": {service: "db", iface: "cali4", ipv4Address: ipv4},
+	}}
+	var got []string
+	for _, ep := range rnet.backends("web") {
+		got = append(got, ep.iface)
+	}
+	if want := []string{"cali1", "cali2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got backends %v, want %v", got, want)
+	}
+	rnet.draining = true
+	if eps := rnet.backends("web"); len(eps) != 0 {
+		t.Errorf("a draining network has %d backends", len(eps))
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// tcpOptions serve the plugin on TCP instead of the unix socket, for
+// daemons in another VM or network namespace.
+type tcpOptions struct {
+	Address string `toml:"address" json:"address"`
+	// Advertise is the address docker dials, Address by default
+	Advertise string `toml:"advertise" json:"advertise"`
+	// the plugin certificate, and the CA of the client certificates
+	// which enables mutual TLS
+	TLSCert string `toml:"tls_cert" json:"tls_cert"`
+	TLSKey  string `toml:"tls_key" json:"tls_key"`
+	TLSCA   string `toml:"tls_ca" json:"tls_ca"`
+	// the files docker uses to connect, written in the spec file
+	DockerCA   string `toml:"docker_ca" json:"docker_ca"`
+	DockerCert string `toml:"docker_cert" json:"docker_cert"`
+	DockerKey  string `toml:"docker_key" json:"docker_key"`
+}
+
+func (o *tcpOptions) tls() bool {
+	return o.TLSCert != ""
+}
+
+func (o *tcpOptions) validate() error {
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key go together")
+	}
+	if !o.tls() && (o.TLSCA != "" || o.DockerCA != "" || o.DockerCert != "" || o.DockerKey != "") {
+		return fmt.Errorf("TLS settings need -tls-cert and -tls-key")
+	}
+	if (o.DockerCert == "") != (o.DockerKey == "") {
+		return fmt.Errorf("-docker-tls-cert and -docker-tls-key go together")
+	}
+	if o.TLSCA != "" && o.DockerCert == "" {
+		return fmt.Errorf("-tls-ca requires client certificates, docker needs -docker-tls-cert and -docker-tls-key")
+	}
+	return nil
+}
+
+// pluginListener listens on the plugin unix socket, or on TCP with
+// optional mutual TLS.
+func pluginListener(o *options) (net.Listener, error) {
+	if o.TCP.Address == "" {
+		// remove socket from last invocation
+		if err := os.Remove(o.Socket); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", o.Socket)
+	}
+
+	if err := o.TCP.validate(); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", o.TCP.Address)
+	if err != nil || !o.TCP.tls() {
+		return l, err
+	}
+	cert, err := tls.LoadX509KeyPair(o.TCP.TLSCert, o.TCP.TLSKey)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if o.TCP.TLSCA != "" {
+		pem, err := ioutil.ReadFile(o.TCP.TLSCA)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			l.Close()
+			return nil, fmt.Errorf("no certificate found in %s", o.TCP.TLSCA)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tls.NewListener(l, config), nil
+}
+
+// pluginSpec is the .json discovery file, the only one carrying TLS
+// settings.
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig *specTLS `json:",omitempty"`
+}
+
+type specTLS struct {
+	InsecureSkipVerify bool
+	CAFile             string `json:",omitempty"`
+	CertFile           string `json:",omitempty"`
+	KeyFile            string `json:",omitempty"`
+}
+
+// writeSpec writes the file docker discovers a TCP plugin with: name.spec
+// holding the URL, or name.json when docker connects with TLS. It returns
+// the path of the file.
+func writeSpec(o *options) (string, error) {
+	addr := o.TCP.Advertise
+	if addr == "" {
+		addr = o.TCP.Address
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host) != nil && net.ParseIP(host).IsUnspecified() {
+		return "", fmt.Errorf("docker cannot dial %s, set -tcp-advertise", addr)
+	}
+	if err := os.MkdirAll(o.SpecDir, 0755); err != nil {
+		return "", err
+	}
+
+	var path string
+	var data []byte
+	if o.TCP.tls() {
+		path = filepath.Join(o.SpecDir, o.Name+".json")
+		spec := &pluginSpec{
+			Name: o.Name,
+			Addr: "https://" + addr,
+			TLSConfig: &specTLS{
+				CAFile:   o.TCP.DockerCA,
+				CertFile: o.TCP.DockerCert,
+				KeyFile:  o.TCP.DockerKey,
+			},
+		}
+		var err error
+		if data, err = json.MarshalIndent(spec, "", "  "); err != nil {
+			return "", err
+		}
+	} else {
+		path = filepath.Join(o.SpecDir, o.Name+".spec")
+		data = []byte("tcp://" + addr)
+	}
+	return path, ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTCPOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    tcpOptions
+		wantErr bool
+	}{
+		{name: "plain", opts: tcpOptions{Address: "127.0.0.1:9000"}},
+		{name: "TLS", opts: tcpOptions{TLSCert: "cert.pem", TLSKey: "key.pem", DockerCA: "ca.pem"}},
+		{
+			name: "mutual TLS",
+			opts: tcpOptions{TLSCert: "cert.pem", TLSKey: "key.pem", TLSCA: "ca.pem", DockerCert: "docker.pem", DockerKey: "docker-key.pem"},
+		},
+		{name: "certificate without key", opts: tcpOptions{TLSCert: "cert.pem"}, wantErr: true},
+		{name: "key without certificate", opts: tcpOptions{TLSKey: "key.pem"}, wantErr: true},
+		{name: "CA without TLS", opts: tcpOptions{TLSCA: "ca.pem"}, wantErr: true},
+		{name: "docker CA without TLS", opts: tcpOptions{DockerCA: "ca.pem"}, wantErr: true},
+		{
+			name:    "docker certificate without key",
+			opts:    tcpOptions{TLSCert: "cert.pem", TLSKey: "key.pem", DockerCert: "docker.pem"},
+			wantErr: true,
+		},
+		{
+			name:    "client CA without docker certificate",
+			opts:    tcpOptions{TLSCert: "cert.pem", TLSKey: "key.pem", TLSCA: "ca.pem"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWriteSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routed-spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		tcp      tcpOptions
+		wantFile string
+		want     string
+		wantErr  bool
+	}{
+		{name: "plain", tcp: tcpOptions{Address: "127.0.0.1:9000"}, wantFile: "plain.spec", want: "tcp://127.0.0.1:9000\n"},
+		{
+			name:     "advertised",
+			tcp:      tcpOptions{Address: "0.0.0.0:9000", Advertise: "192.0.2.1:9000"},
+			wantFile: "advertised.spec",
+			want:     "tcp://192.0.2.1:9000\n",
+		},
+		{
+			name:     "tls",
+			tcp:      tcpOptions{Address: "192.0.2.1:9000", TLSCert: "cert.pem", TLSKey: "key.pem", DockerCA: "ca.pem"},
+			wantFile: "tls.json",
+			want: `{
+  "Name": "tls",
+  "Addr": "https://192.0.2.1:9000",
+  "TLSConfig": {
+    "InsecureSkipVerify": false,
+    "CAFile": "ca.pem"
+  }
+}
+`,
+		},
+		{name: "unspecified", tcp: tcpOptions{Address: "0.0.0.0:9000"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		path, err := writeSpec(&options{Name: tt.name, SpecDir: dir, TCP: tt.tcp})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if path != filepath.Join(dir, tt.wantFile) {
+			t.Errorf("%s: wrote %s, want %s", tt.name, path, tt.wantFile)
+		}
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != tt.want {
+			t.Errorf("%s: got %q (%v), want %q", tt.name, b, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/Sirupsen/logrus/formatters/logstash"
+	logrus_syslog "github.com/Sirupsen/logrus/hooks/syslog"
+	"log/syslog"
+	"strings"
+)
+
+// setupLogging sets the log level and format and adds the syslog hook.
+func setupLogging(o *logOptions) error {
+	if err := applyLogOptions(o); err != nil {
+		return err
+	}
+	syslogAddress := o.Syslog
+	if syslogAddress == "" {
+		return nil
+	}
+	var network, raddr string
+	if syslogAddress != "local" {
+		parts := strings.SplitN(syslogAddress, "://", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid syslog address %q", syslogAddress)
+		}
+		network, raddr = parts[0], parts[1]
+	}
+	hook, err := logrus_syslog.NewSyslogHook(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "routed")
+	if err != nil {
+		return fmt.Errorf("unable to connect to syslog: %s", err)
+	}
+	log.AddHook(hook)
+	return nil
+}
+
+// applyLogOptions sets the log level and format, which can change while
+// running.
+func applyLogOptions(o *logOptions) error {
+	level, err := log.ParseLevel(o.Level)
+	if err != nil {
+		return err
+	}
+	var formatter log.Formatter
+	switch o.Format {
+	case "text":
+		formatter = &log.TextFormatter{}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	case "logstash":
+		formatter = &logstash.LogstashFormatter{Type: "routed"}
+	default:
+		return fmt.Errorf("unknown log format %q", o.Format)
+	}
+	log.SetLevel(level)
+	log.SetFormatter(formatter)
+	return nil
+}
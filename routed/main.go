@@ -1,72 +1,231 @@
 package main
 
 import (
+	"context"
 	"flag"
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/reexec"
+	"github.com/jc-m/test-docker-plugin/routed/admin"
 	"github.com/jc-m/test-docker-plugin/routed/driver"
 	"github.com/jc-m/test-docker-plugin/routed/server"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 func main() {
+	// published ports re-execute this binary as docker-proxy
+	if reexec.Init() {
+		return
+	}
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 
 	var (
-		address  string
-		logLevel string
-		version  string
+		configFile string
+		version    string
 	)
+	opts := defaultOptions()
+	opts.register(flag.CommandLine)
+	flag.StringVar(&configFile, "config", "", "TOML or JSON (.json) configuration file, reloaded on SIGHUP")
 
-	flag.StringVar(&address, "socket", "/run/docker/plugins/routed.sock", "socket on which to listen")
-	flag.StringVar(&logLevel, "log-level", "info", "logging level (debug, info, warning, error)")
-
+	flag.Usage = usage
 	flag.Parse()
 
-	level, err := log.ParseLevel(logLevel)
-	if err != nil {
+	if configFile != "" {
+		var err error
+		if opts, err = loadOptions(configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := setupLogging(&opts.Log); err != nil {
 		log.Fatal(err)
 	}
-	log.SetLevel(level)
 
 	log.Info("Test routed network plugin")
 
 	version = "1"
-	var d server.Driver
-	d, err = driver.New(version)
+	d, err := driver.New(version, opts.driverConfig())
 	if err != nil {
 		log.Fatalf("unable to create driver: %s", err)
 	}
-	var listener net.Listener
-
-	// remove socket from last invocation
-	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+	adminAddress := opts.Admin.Socket
+	activated, err := activationListeners()
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	listener, err = net.Listen("unix", address)
+	access, err := opts.Access.peerAccess()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("invalid access settings: %s", err)
+	}
+
+	// files removed on exit, the sockets passed by systemd are its own
+	files := []string{}
+	listener, ok := activated[activationPlugin]
+	if !ok {
+		listener, err = pluginListener(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if opts.TCP.Address == "" {
+			if err := opts.Access.secure(opts.Socket); err != nil {
+				log.Fatalf("unable to secure %s: %s", opts.Socket, err)
+			}
+			files = append(files, opts.Socket)
+		}
+	}
+	listener = access.listener(listener)
+	if opts.TCP.Address != "" && opts.SpecDir != "" {
+		spec, err := writeSpec(opts)
+		if err != nil {
+			log.Fatalf("unable to write the plugin spec: %s", err)
+		}
+		log.Infof("Wrote %s", spec)
+		files = append(files, spec)
+	}
+
+	// the admin socket must not live in the plugin directory, docker
+	// would take it for another plugin
+	adminListener, ok := activated[activationAdmin]
+	if !ok && adminAddress != "" {
+		if err := os.MkdirAll(filepath.Dir(adminAddress), 0755); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Remove(adminAddress); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		adminListener, err = net.Listen("unix", adminAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := opts.Access.secure(adminAddress); err != nil {
+			log.Fatalf("unable to secure %s: %s", adminAddress, err)
+		}
+		files = append(files, adminAddress)
+	}
+	if adminListener != nil {
+		adminListener = access.listener(adminListener)
+	}
+
+	serverConfig := opts.serverConfig()
+	var recordOut *os.File
+	if opts.Record != "" {
+		recordOut, err = os.OpenFile(opts.Record, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverConfig.Record = recordOut
 	}
-	defer listener.Close()
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, os.Kill, syscall.SIGTERM)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	endChan := make(chan error, 1)
+	endChan := make(chan error, 2)
+	servers := []*http.Server{{Handler: server.Handler(d, serverConfig)}}
 	go func() {
-		endChan <- server.Listen(listener, d)
+		endChan <- servers[0].Serve(listener)
 	}()
+	if adminListener != nil {
+		adminServer := &http.Server{Handler: admin.Handler(d)}
+		go func() {
+			endChan <- adminServer.Serve(adminListener)
+		}()
+		servers = append(servers, adminServer)
+	}
+	log.Info("Serving Requests")
+	sdNotify("READY=1")
+	go watchdog(d)
 
-	select {
-	case sig := <-sigChan:
-		log.Debugf("Caught signal %s; shutting down", sig)
-	case err := <-endChan:
-		if err != nil {
-			log.Errorf("Error from listener: ", err)
-			listener.Close()
-			os.Exit(1)
+	status := 0
+	for running := true; running; {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				sdNotify("RELOADING=1")
+				opts = reload(configFile, opts, d)
+				sdNotify("READY=1")
+				continue
+			}
+			log.Infof("Caught signal %s; shutting down", sig)
+		case err := <-endChan:
+			log.Errorf("Error from listener: %s", err)
+			status = 1
+		}
+		running = false
+	}
+	sdNotify("STOPPING=1")
+	shutdown(d, servers, files, opts.ShutdownTimeout.Duration, opts.CleanupOnExit)
+	if recordOut != nil {
+		recordOut.Close()
+	}
+	os.Exit(status)
+}
+
+// reload re-reads the configuration file and applies the settings that can
+// change while running. The others keep their current value.
+func reload(path string, current *options, d driver.Plugin) *options {
+	if path == "" {
+		log.Warn("No configuration file to reload")
+		return current
+	}
+	o, err := loadOptions(path)
+	if err != nil {
+		log.Errorf("Configuration not reloaded: %s", err)
+		return current
+	}
+	if o.Name != current.Name || o.Socket != current.Socket || o.TCP != current.TCP || o.SpecDir != current.SpecDir || o.Access != current.Access ||
+		o.RPCTimeout != current.RPCTimeout || !reflect.DeepEqual(o.RPCTimeouts, current.RPCTimeouts) ||
+		o.Admin.Socket != current.Admin.Socket || o.Record != current.Record || o.Log.Syslog != current.Log.Syslog {
+		log.Warn("Listener, access, timeout, admin socket, record and syslog settings kept: restart to change them")
+		o.Name, o.Socket, o.TCP, o.SpecDir, o.Access = current.Name, current.Socket, current.TCP, current.SpecDir, current.Access
+		o.RPCTimeout, o.RPCTimeouts = current.RPCTimeout, current.RPCTimeouts
+		o.Admin.Socket, o.Record, o.Log.Syslog = current.Admin.Socket, current.Record, current.Log.Syslog
+	}
+	if err := applyLogOptions(&o.Log); err != nil {
+		log.Warnf("Logging settings kept: %s", err)
+		o.Log = current.Log
+	}
+	for _, err := range d.Reconfigure(o.driverConfig()) {
+		log.Warnf("Configuration change rejected: %s", err)
+	}
+	log.Infof("Reloaded %s", path)
+	return o
+}
+
+// shutdown stops accepting requests and waits at most timeout for the
+// requests in flight. It then removes the sockets and spec file and, with
+// removeDatapath, the host state programmed by the driver.
+func shutdown(d driver.Plugin, servers []*http.Server, files []string, timeout time.Duration, removeDatapath bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Warnf("Requests still in flight after %s, closing their connections: %s", timeout, err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	d.Shutdown(removeDatapath)
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Unable to remove %s: %s", file, err)
 		}
 	}
+	log.Info("Stopped")
 }
@@ -0,0 +1,251 @@
+// Package metrics implements the few Prometheus metric types the plugin
+// needs and their text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the latency buckets, in seconds, of the RPC histograms.
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w *Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+// NewCounterVec creates and registers a counter.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter of the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter of the label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[joinValues(values)] += v
+}
+
+func (c *CounterVec) write(w *Writer) {
+	c.Lock()
+	defer c.Unlock()
+	w.header(c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		w.sample(c.name, c.labels, splitValues(key), c.values[key])
+	}
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates and registers a histogram with the given upper
+// bucket bounds.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+	register(h)
+	return h
+}
+
+// Observe records v for the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := joinValues(values)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w *Writer) {
+	h.Lock()
+	defer h.Unlock()
+	w.header(h.name, h.help, "histogram")
+	labels := append(append([]string{}, h.labels...), "le")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		values := splitValues(key)
+		le := func(bound string) []string {
+			return append(append([]string{}, values...), bound)
+		}
+		for i, bound := range h.buckets {
+			w.sample(h.name+"_bucket", labels, le(formatFloat(bound)), float64(hist.counts[i]))
+		}
+		w.sample(h.name+"_bucket", labels, le("+Inf"), float64(hist.count))
+		w.sample(h.name+"_sum", h.labels, values, hist.sum)
+		w.sample(h.name+"_count", h.labels, values, float64(hist.count))
+	}
+}
+
+// Sample is one value of a metric collected at scrape time.
+type Sample struct {
+	Values []string
+	Value  float64
+}
+
+// Writer formats metrics in the text exposition format.
+type Writer struct {
+	buf bytes.Buffer
+}
+
+// Gauge writes a gauge collected at scrape time.
+func (w *Writer) Gauge(name, help string, labels []string, samples []Sample) {
+	w.collected(name, help, "gauge", labels, samples)
+}
+
+// Counter writes a counter maintained outside of this package, such as the
+// kernel interface statistics.
+func (w *Writer) Counter(name, help string, labels []string, samples []Sample) {
+	w.collected(name, help, "counter", labels, samples)
+}
+
+func (w *Writer) collected(name, help, typ string, labels []string, samples []Sample) {
+	w.header(name, help, typ)
+	for _, s := range samples {
+		w.sample(name, labels, s.Values, s.Value)
+	}
+}
+
+func (w *Writer) header(name, help, typ string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, escape(help, false), name, typ)
+}
+
+func (w *Writer) sample(name string, labels, values []string, v float64) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			fmt.Fprintf(&w.buf, "%s=\"%s\"", label, escape(value, true))
+		}
+		w.buf.WriteByte('}')
+	}
+	fmt.Fprintf(&w.buf, " %s\n", formatFloat(v))
+}
+
+// Handler serves the registered metrics followed by those written by the
+// collect functions.
+func Handler(collect ...func(w *Writer)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := &Writer{}
+		registryMu.Lock()
+		metrics := append([]metric{}, registry...)
+		registryMu.Unlock()
+		for _, m := range metrics {
+			m.write(w)
+		}
+		for _, c := range collect {
+			c(w)
+		}
+		rw.Header().Set("Content-Type", ContentType)
+		rw.Write(w.buf.Bytes())
+	})
+}
+
+// label values are joined into a map key with a byte that cannot appear in
+// them
+const sep = "\xff"
+
+func joinValues(values []string) string {
+	return strings.Join(values, sep)
+}
+
+func splitValues(key string) []string {
+	return strings.Split(key, sep)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/jc-m/test-docker-plugin/routed/driver"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"github.com/vishvananda/netlink"
+	"net"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// set in the environment of the replay re-executed in its own network
+// namespace
+const replayNetnsEnv = "ROUTED_REPLAY_NETNS"
+
+// runReplay feeds a recording to a new driver and reports the responses
+// that differ from the recorded ones.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	datapath := flags.String("datapath", "netns", "netns: program a throwaway network namespace, host: program the host")
+	logLevel := flags.String("log-level", "warning", "logging level of the driver")
+	configFile := flags.String("config", "", "configuration file of the recorded plugin, for its pool and datapath settings")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (*datapath != "netns" && *datapath != "host") {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [-datapath netns|host] [-config file] <recording>\n", os.Args[0])
+		return 2
+	}
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+	log.SetLevel(level)
+
+	inNetns := os.Getenv(replayNetnsEnv) != ""
+	if *datapath == "netns" && !inNetns {
+		return replayInNetns(*logLevel, *configFile, flags.Arg(0))
+	}
+	opts := defaultOptions()
+	if *configFile != "" {
+		if opts, err = loadOptions(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	if inNetns {
+		if lo, err := netlink.LinkByName("lo"); err == nil {
+			netlink.LinkSetUp(lo)
+		}
+	}
+	config := opts.driverConfig()
+	// only the sysctls of the throwaway namespace are fixed
+	config.FixSysctls = inNetns
+	d, err := driver.New("1", config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: unable to create driver: %s\n", err)
+		return 1
+	}
+	handler := server.Handler(d, &server.Config{})
+
+	diffs, n := 0, 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record server.Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: record %d: %s\n", n+1, err)
+			return 1
+		}
+		n++
+
+		request := record.Request
+		if record.Path == "/IpamDriver.RequestAddress" {
+			request = recordedAddress(record)
+		}
+		req := httptest.NewRequest("POST", record.Path, bytes.NewReader(request))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		want, got := canonicalJSON(record.Response), canonicalJSON(rec.Body.Bytes())
+		rpc := strings.TrimPrefix(record.Path, "/")
+		if want == got && record.Status == rec.Code {
+			fmt.Printf("%4d %-40s ok\n", n, rpc)
+			continue
+		}
+		diffs++
+		fmt.Printf("%4d %-40s DIFF\n", n, rpc)
+		fmt.Printf("       request:  %s\n", canonicalJSON(record.Request))
+		fmt.Printf("       recorded: %d %s\n", record.Status, want)
+		fmt.Printf("       replayed: %d %s\n", rec.Code, got)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	fmt.Printf("%d requests replayed, %d differ\n", n, diffs)
+	if diffs > 0 {
+		return 1
+	}
+	return 0
+}
+
+// recordedAddress returns the request of a recorded address allocation
+// asking for the address the recording got, so that the following
+// responses match even if the allocator picked it differently.
+func recordedAddress(record server.Record) []byte {
+	var resp struct{ Address string }
+	var req map[string]interface{}
+	if record.Err != "" || json.Unmarshal(record.Response, &resp) != nil || json.Unmarshal(record.Request, &req) != nil {
+		return record.Request
+	}
+	ip, _, err := net.ParseCIDR(resp.Address)
+	if err != nil {
+		return record.Request
+	}
+	req["Address"] = ip.String()
+	b, err := json.Marshal(req)
+	if err != nil {
+		return record.Request
+	}
+	return b
+}
+
+// replayInNetns runs the replay again in new network namespace, so that
+// the driver programs a copy of the datapath that vanishes with it.
+func replayInNetns(logLevel, configFile, recording string) int {
+	args := []string{"replay", "-datapath", "host", "-log-level", logLevel}
+	if configFile != "" {
+		args = append(args, "-config", configFile)
+	}
+	cmd := exec.Command("/proc/self/exe", append(args, recording)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), replayNetnsEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if os.Getuid() != 0 {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	}
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		fmt.Fprintf(os.Stderr, "Error: unable to run in a network namespace: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// canonicalJSON re-encodes a JSON value with sorted keys so that responses
+// compare regardless of field order.
+func canonicalJSON(b []byte) string {
+	b = bytes.TrimSpace(b)
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		// not JSON, such as http.Error responses
+		v = string(b)
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
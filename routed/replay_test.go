@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jc-m/test-docker-plugin/routed/server"
+	"testing"
+)
+
+func TestRecordedAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		record server.Record
+		want   string
+	}{
+		{
+			name: "allocated",
+			record: server.Record{
+				Request:  json.RawMessage(`{"PoolID":"10.46.0.0/24","Address":""}`),
+				Response: json.RawMessage(`{"Address":"10.46.0.7/32"}`),
+			},
+			want: `{"Address":"10.46.0.7","PoolID":"10.46.0.0/24"}`,
+		},
+		{
+			name: "failed",
+			record: server.Record{
+				Request:  json.RawMessage(`{"PoolID":"10.46.0.0/24"}`),
+				Response: json.RawMessage(`{"Err":"pool exhausted"}`),
+				Err:      "pool exhausted",
+			},
+			want: `{"PoolID":"10.46.0.0/24"}`,
+		},
+		{
+			name: "no address",
+			record: server.Record{
+				Request:  json.RawMessage(`{"PoolID":"10.46.0.0/24"}`),
+				Response: json.RawMessage(`{}`),
+			},
+			want: `{"PoolID":"10.46.0.0/24"}`,
+		},
+		{
+			name:   "no response",
+			record: server.Record{Request: json.RawMessage(`{"PoolID":"10.46.0.0/24"}`)},
+			want:   `{"PoolID":"10.46.0.0/24"}`,
+		},
+	}
+	for _, tt := range tests {
+		if got := string(recordedAddress(tt.record)); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "sorted keys", in: `{"b":1,"a":{"d":2,"c":3}}`, want: `{"a":{"c":3,"d":2},"b":1}`},
+		{name: "whitespace", in: " {\"a\": [1, 2]}\n", want: `{"a":[1,2]}`},
+		{name: "not JSON", in: "404 page not found\n", want: `"404 page not found"`},
+		{name: "empty", in: "", want: `""`},
+	}
+	for _, tt := range tests {
+		if got := canonicalJSON([]byte(tt.in)); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
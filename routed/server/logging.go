@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+)
+
+// Fields added to the log lines of a request.
+const (
+	fieldRequestID  = "request_id"
+	fieldRPC        = "rpc"
+	fieldNetworkID  = "network_id"
+	fieldEndpointID = "endpoint_id"
+	fieldPoolID     = "pool_id"
+)
+
+// requestIDs are the identifiers found in the plugin requests bodies.
+type requestIDs struct {
+	NetworkID  string
+	EndpointID string
+	PoolID     string
+}
+
+type loggerKey struct{}
+
+// Logger returns the logger of the request served with ctx, whose lines
+// carry the request fields, or the standard logger outside of a request.
+func Logger(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(loggerKey{}).(*log.Entry); ok {
+		return entry
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logRequests tags the log lines of each request with a request ID, the
+// RPC name and the network, endpoint and pool IDs of the request, and
+// passes the logger carrying them in the request context.
+func logRequests(next http.Handler, rpcName func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := log.Fields{
+			fieldRequestID: newRequestID(),
+			fieldRPC:       rpcName(r),
+		}
+		if r.Body != nil {
+			body, err := ioutil.ReadAll(r.Body)
+			if err == nil {
+				var ids requestIDs
+				json.Unmarshal(body, &ids)
+				for k, v := range map[string]string{
+					fieldNetworkID:  ids.NetworkID,
+					fieldEndpointID: ids.EndpointID,
+					fieldPoolID:     ids.PoolID,
+				} {
+					if v != "" {
+						fields[k] = v
+					}
+				}
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		w.Header().Set("X-Request-Id", fields[fieldRequestID].(string))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, log.WithFields(fields))))
+	})
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/jc-m/test-docker-plugin/routed/metrics"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	rpcRequests = metrics.NewCounterVec("routed_rpc_requests_total",
+		"Plugin RPCs handled.", "rpc")
+	rpcErrors = metrics.NewCounterVec("routed_rpc_errors_total",
+		"Plugin RPCs that returned an error.", "rpc")
+	rpcDuration = metrics.NewHistogramVec("routed_rpc_duration_seconds",
+		"Latency of the plugin RPCs.", metrics.DefBuckets, "rpc")
+)
+
+// responseRecorder remembers whether the handler answered with an error.
+// Plugin errors are sent with a 200 status and an Err field.
+type responseRecorder struct {
+	http.ResponseWriter
+	failed bool
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if code >= http.StatusBadRequest {
+		rec.failed = true
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// setFailed marks the response of w as an error, for the handlers that
+// answer with an Err field. It looks through the writer of the record
+// middleware.
+func setFailed(w http.ResponseWriter) {
+	for {
+		switch rec := w.(type) {
+		case *responseRecorder:
+			rec.failed = true
+			return
+		case *bodyRecorder:
+			w = rec.ResponseWriter
+		default:
+			return
+		}
+	}
+}
+
+// rpcNamer returns the RPC a request calls, "unknown" for the requests no
+// route matches so that the metric labels stay bounded.
+func rpcNamer(router *mux.Router) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if !router.Match(r, &mux.RouteMatch{}) {
+			return "unknown"
+		}
+		return strings.TrimPrefix(r.URL.Path, "/")
+	}
+}
+
+// instrument counts the requests served by next, their errors and their
+// latency.
+func instrument(next http.Handler, rpcName func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rpc := rpcName(r)
+		rec := &responseRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		rpcDuration.Observe(time.Since(start).Seconds(), rpc)
+		rpcRequests.Inc(rpc)
+		if rec.failed {
+			rpcErrors.Inc(rpc)
+		}
+	})
+}
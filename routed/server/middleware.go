@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// ContentType is the media type of the plugin protocol.
+const ContentType = "application/vnd.docker.plugins.v1+json"
+
+// DefaultTimeout is the deadline of the RPCs without a configured one.
+// Docker gives up on a plugin call after 30s.
+const DefaultTimeout = 25 * time.Second
+
+// contentType sets the plugin media type on every response.
+func contentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverPanics turns a panic of a handler into an error response instead
+// of a dropped connection, and logs its stack.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				Logger(r.Context()).Errorf("Panic serving %s: %v\n%s", r.URL.Path, p, debug.Stack())
+				sendError(w, r, fmt.Sprintf("internal error serving %s: %v", r.URL.Path, p), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deadline gives the request context the timeout of its RPC. The driver
+// stops a call past it at its next check, removes what the call programmed
+// and returns an error. The response waits for the driver: answering
+// earlier would let docker retry while the call still changes the
+// datapath.
+func deadline(next http.Handler, rpcName func(r *http.Request) string, timeouts map[string]time.Duration, def time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rpc := rpcName(r)
+		timeout, ok := timeouts[rpc]
+		if !ok {
+			timeout = def
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+		if ctx.Err() == context.DeadlineExceeded {
+			Logger(r.Context()).Warnf("%s did not complete within %s", rpc, timeout)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentType(t *testing.T) {
+	h := contentType(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		emptyResponse(w)
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/Plugin.Activate", nil))
+	if got := rec.Header().Get("Content-Type"); got != ContentType {
+		t.Errorf("got content type %q, want %q", got, ContentType)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/NetworkDriver.Join", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `"Err"`) || !strings.Contains(body, "boom") {
+		t.Errorf("got body %s, want an Err with the panic", body)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	rpcName := func(r *http.Request) string {
+		return strings.TrimPrefix(r.URL.Path, "/")
+	}
+	timeouts := map[string]time.Duration{
+		"NetworkDriver.Join":  10 * time.Millisecond,
+		"NetworkDriver.Leave": -1,
+	}
+	tests := []struct {
+		name         string
+		rpc          string
+		wantDeadline bool
+		wantErr      bool
+	}{
+		{name: "in time", rpc: "NetworkDriver.CreateNetwork", wantDeadline: true},
+		{name: "past its deadline", rpc: "NetworkDriver.Join", wantDeadline: true, wantErr: true},
+		{name: "no deadline", rpc: "NetworkDriver.Leave"},
+	}
+	for _, tt := range tests {
+		done := false
+		h := deadline(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			_, ok := ctx.Deadline()
+			if ok != tt.wantDeadline {
+				t.Errorf("%s: deadline %t, want %t", tt.name, ok, tt.wantDeadline)
+			}
+			if tt.wantErr {
+				// the driver stops at its next check
+				<-ctx.Done()
+			}
+			time.Sleep(10 * time.Millisecond)
+			done = true
+			emptyOrErrorResponse(w, ctx.Err())
+		}), rpcName, timeouts, time.Minute)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/"+tt.rpc, nil).WithContext(context.Background()))
+		if !done {
+			t.Errorf("%s: answered before the handler completed", tt.name)
+		}
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, http.StatusOK)
+		}
+		if gotErr := strings.Contains(rec.Body.String(), `"Err"`); gotErr != tt.wantErr {
+			t.Errorf("%s: got body %s, want error %t", tt.name, rec.Body, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Record is one plugin request and its response, as written to the
+// recording file, one JSON object per line.
+type Record struct {
+	Time     time.Time
+	Path     string
+	Request  json.RawMessage `json:",omitempty"`
+	Response json.RawMessage `json:",omitempty"`
+	Status   int
+	Latency  time.Duration
+	// Err is the error returned to docker, if any
+	Err string `json:",omitempty"`
+}
+
+// bodyRecorder keeps a copy of the response.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *bodyRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *bodyRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// rawJSON returns b as a raw JSON value, or as a JSON string when it is not
+// JSON, as are the http.Error responses.
+func rawJSON(b []byte) json.RawMessage {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil
+	}
+	if json.Valid(b) {
+		return json.RawMessage(b)
+	}
+	s, _ := json.Marshal(string(b))
+	return json.RawMessage(s)
+}
+
+// recordRequests appends every request served by next and its response to
+// out.
+func recordRequests(next http.Handler, out io.Writer) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(r.Body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+
+		record := &Record{
+			Time:     start,
+			Path:     r.URL.Path,
+			Request:  rawJSON(body),
+			Response: rawJSON(rec.body.Bytes()),
+			Status:   rec.status,
+			Latency:  time.Since(start),
+		}
+		var resp struct{ Err string }
+		if json.Unmarshal(record.Response, &resp) == nil {
+			record.Err = resp.Err
+		}
+		if rec.status >= http.StatusBadRequest && record.Err == "" {
+			record.Err = http.StatusText(rec.status)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err := json.NewEncoder(out).Encode(record); err != nil {
+			Logger(r.Context()).Errorf("Unable to record %s: %s", r.URL.Path, err)
+		}
+	})
+}
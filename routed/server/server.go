@@ -1,42 +1,76 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"net"
+	"io"
 	"net/http"
-	log "github.com/Sirupsen/logrus"
+	"time"
     netApi"github.com/docker/libnetwork/drivers/remote/api"
 	ipamApi"github.com/docker/libnetwork/ipams/remote/api"
 	"github.com/gorilla/mux"
 )
 
 
+// Driver serves the plugin calls. The context of a call is canceled at its
+// deadline or when docker gives up, and carries the request logger, see
+// Logger.
 type Driver interface {
-	GetCapabilities() (*netApi.GetCapabilityResponse, error)
-	CreateNetwork(create *netApi.CreateNetworkRequest) error
-	DeleteNetwork(delete *netApi.DeleteNetworkRequest) error
-	CreateEndpoint(create *netApi.CreateEndpointRequest) (*netApi.CreateEndpointResponse, error)
-	DeleteEndpoint(delete *netApi.DeleteEndpointRequest) error
-	EndpointInfo(req *netApi.EndpointInfoRequest) (*netApi.EndpointInfoResponse, error)
-	JoinEndpoint(j *netApi.JoinRequest) (response *netApi.JoinResponse, error error)
-	LeaveEndpoint(leave *netApi.LeaveRequest) error
-	GetIPAMCapabilities() (*ipamApi.GetCapabilityResponse, error)
-	GetDefaultAddressSpaces() (*ipamApi.GetAddressSpacesResponse, error)
-	RequestPool(p *ipamApi.RequestPoolRequest) (*ipamApi.RequestPoolResponse, error)
-	RequestAddress(a *ipamApi.RequestAddressRequest) (*ipamApi.RequestAddressResponse, error)
-	ReleaseAddress(a *ipamApi.ReleaseAddressRequest) error
-	ReleasePool(a *ipamApi.ReleasePoolRequest) error
-	
+	GetCapabilities(ctx context.Context) (*netApi.GetCapabilityResponse, error)
+	CreateNetwork(ctx context.Context, create *netApi.CreateNetworkRequest) error
+	DeleteNetwork(ctx context.Context, delete *netApi.DeleteNetworkRequest) error
+	CreateEndpoint(ctx context.Context, create *netApi.CreateEndpointRequest) (*netApi.CreateEndpointResponse, error)
+	DeleteEndpoint(ctx context.Context, delete *netApi.DeleteEndpointRequest) error
+	EndpointInfo(ctx context.Context, req *netApi.EndpointInfoRequest) (*netApi.EndpointInfoResponse, error)
+	JoinEndpoint(ctx context.Context, j *netApi.JoinRequest) (response *netApi.JoinResponse, error error)
+	LeaveEndpoint(ctx context.Context, leave *netApi.LeaveRequest) error
+	GetIPAMCapabilities(ctx context.Context) (*ipamApi.GetCapabilityResponse, error)
+	GetDefaultAddressSpaces(ctx context.Context) (*ipamApi.GetAddressSpacesResponse, error)
+	RequestPool(ctx context.Context, p *ipamApi.RequestPoolRequest) (*ipamApi.RequestPoolResponse, error)
+	RequestAddress(ctx context.Context, a *ipamApi.RequestAddressRequest) (*ipamApi.RequestAddressResponse, error)
+	ReleaseAddress(ctx context.Context, a *ipamApi.ReleaseAddressRequest) error
+	ReleasePool(ctx context.Context, a *ipamApi.ReleasePoolRequest) error
+	DiscoverNew(ctx context.Context, notif *netApi.DiscoveryNotification) error
+	DiscoverDelete(ctx context.Context, notif *netApi.DiscoveryNotification) error
+	ProgramExternalConnectivity(ctx context.Context, p *ProgramExternalConnectivityRequest) error
+	RevokeExternalConnectivity(ctx context.Context, r *RevokeExternalConnectivityRequest) error
+}
+
+// ProgramExternalConnectivityRequest describes the API for programming the
+// external connectivity (published ports) of an endpoint. The vendored
+// libnetwork remote API predates this call.
+type ProgramExternalConnectivityRequest struct {
+	NetworkID  string
+	EndpointID string
+	Options    map[string]interface{}
+}
+
+// RevokeExternalConnectivityRequest describes the API for removing the
+// external connectivity of an endpoint.
+type RevokeExternalConnectivityRequest struct {
+	NetworkID  string
+	EndpointID string
 }
 
 type server struct {
 	d Driver
 }
 
+// Config holds the options of the plugin server.
+type Config struct {
+	// Record receives a Record of every request when set
+	Record io.Writer
+	// Timeout is the deadline of the RPCs, DefaultTimeout when zero and
+	// none when negative. Timeouts overrides it by RPC name, such as
+	// "NetworkDriver.Join".
+	Timeout  time.Duration
+	Timeouts map[string]time.Duration
+}
 
-
-func Listen(socket net.Listener, driver Driver) error {
+// Handler returns the handler of the plugin requests, also used to replay
+// recordings.
+func Handler(driver Driver, config *Config) http.Handler {
 	router := mux.NewRouter()
 	router.NotFoundHandler = http.HandlerFunc(notFound)
 
@@ -53,6 +87,10 @@ func Listen(socket net.Listener, driver Driver) error {
 	router.Methods("POST").Path("/NetworkDriver.EndpointOperInfo").HandlerFunc(server.infoEndpoint)
 	router.Methods("POST").Path("/NetworkDriver.Join").HandlerFunc(server.joinEndpoint)
 	router.Methods("POST").Path("/NetworkDriver.Leave").HandlerFunc(server.leaveEndpoint)
+	router.Methods("POST").Path("/NetworkDriver.DiscoverNew").HandlerFunc(server.discoverNew)
+	router.Methods("POST").Path("/NetworkDriver.DiscoverDelete").HandlerFunc(server.discoverDelete)
+	router.Methods("POST").Path("/NetworkDriver.ProgramExternalConnectivity").HandlerFunc(server.programExternalConnectivity)
+	router.Methods("POST").Path("/NetworkDriver.RevokeExternalConnectivity").HandlerFunc(server.revokeExternalConnectivity)
 	
 	// IPAM plugin methods
 	router.Methods("POST").Path("/IpamDriver.GetCapabilities").HandlerFunc(server.getIPAMCapabilities)
@@ -62,10 +100,16 @@ func Listen(socket net.Listener, driver Driver) error {
 	router.Methods("POST").Path("/IpamDriver.ReleaseAddress").HandlerFunc(server.releaseAddress)
 	router.Methods("POST").Path("/IpamDriver.ReleasePool").HandlerFunc(server.releasePool)
 	
-
-    log.Info("Serving Requests")
-
-    return http.Serve(socket, router)
+	rpcName := rpcNamer(router)
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	handler := deadline(recoverPanics(router), rpcName, config.Timeouts, timeout)
+	if config.Record != nil {
+		handler = recordRequests(handler, config.Record)
+	}
+	return contentType(instrument(logRequests(handler, rpcName), rpcName))
 }
 
 type activateResp struct {
@@ -73,13 +117,13 @@ type activateResp struct {
 }
 
 func activate(w http.ResponseWriter, r *http.Request) {
-	log.Info("Processing Activation Request")
+	Logger(r.Context()).Info("Processing Activation Request")
     resp := &activateResp {
 		[]string{"NetworkDriver","IpamDriver"},
 	}
 	err := json.NewEncoder(w).Encode(resp)
 	if err != nil {
-		sendError(w, "encode error", http.StatusInternalServerError)
+		sendError(w, r, "encode error", http.StatusInternalServerError)
 		return
 	}
 }
@@ -87,155 +131,194 @@ func activate(w http.ResponseWriter, r *http.Request) {
 // Driver invocations ---
 
 func (server *server) getCapabilities(w http.ResponseWriter, r *http.Request) {
-	log.Info("Processing GetCapabilities Request")
-	caps, err := server.d.GetCapabilities()
-	objectOrErrorResponse(w, caps, err)
+	Logger(r.Context()).Info("Processing GetCapabilities Request")
+	caps, err := server.d.GetCapabilities(r.Context())
+	objectOrErrorResponse(w, r, caps, err)
 }
 
 func (server *server) createNetwork(w http.ResponseWriter, r *http.Request) {
 	var create netApi.CreateNetworkRequest
 	err := json.NewDecoder(r.Body).Decode(&create)
 	if err != nil {
-		sendError(w, "Unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
+		sendError(w, r, "Unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	emptyOrErrorResponse(w, server.d.CreateNetwork(&create))
+	emptyOrErrorResponse(w, server.d.CreateNetwork(r.Context(), &create))
 }
 
 func (server *server) deleteNetwork(w http.ResponseWriter, r *http.Request) {
 	var delete netApi.DeleteNetworkRequest
 	if err := json.NewDecoder(r.Body).Decode(&delete); err != nil {
-		sendError(w, "Unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
+		sendError(w, r, "Unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	emptyOrErrorResponse(w, server.d.DeleteNetwork(&delete))
+	emptyOrErrorResponse(w, server.d.DeleteNetwork(r.Context(), &delete))
 }
 
 func (server *server) createEndpoint(w http.ResponseWriter, r *http.Request) {
 	var create netApi.CreateEndpointRequest
 	if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
-		sendError(w, "unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
+		sendError(w, r, "unable to decode JSON payload: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	res, err := server.d.CreateEndpoint(&create)
-	objectOrErrorResponse(w, res, err)
+	res, err := server.d.CreateEndpoint(r.Context(), &create)
+	objectOrErrorResponse(w, r, res, err)
 }
 
 func (server *server) deleteEndpoint(w http.ResponseWriter, r *http.Request) {
 	var delete netApi.DeleteEndpointRequest
 	if err := json.NewDecoder(r.Body).Decode(&delete); err != nil {
-		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
 		return
 	}
-	emptyOrErrorResponse(w, server.d.DeleteEndpoint(&delete))
+	emptyOrErrorResponse(w, server.d.DeleteEndpoint(r.Context(), &delete))
 }
 
 func (server *server) infoEndpoint(w http.ResponseWriter, r *http.Request) {
 	var req netApi.EndpointInfoRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
 		return
 	}
-	info, err := server.d.EndpointInfo(&req)
-	objectOrErrorResponse(w, info, err)
+	info, err := server.d.EndpointInfo(r.Context(), &req)
+	objectOrErrorResponse(w, r, info, err)
 }
 
 func (server *server) joinEndpoint(w http.ResponseWriter, r *http.Request) {
 	var join netApi.JoinRequest
 	if err := json.NewDecoder(r.Body).Decode(&join); err != nil {
-		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
 		return
 	}
-	res, err := server.d.JoinEndpoint(&join)
-	objectOrErrorResponse(w, res, err)
+	res, err := server.d.JoinEndpoint(r.Context(), &join)
+	objectOrErrorResponse(w, r, res, err)
 }
 
 func (server *server) leaveEndpoint(w http.ResponseWriter, r *http.Request) {
 	var l netApi.LeaveRequest
 	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
-		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
+		return
+	}
+	emptyOrErrorResponse(w, server.d.LeaveEndpoint(r.Context(), &l))
+}
+
+func (server *server) discoverNew(w http.ResponseWriter, r *http.Request) {
+	var notif netApi.DiscoveryNotification
+	if err := json.NewDecoder(r.Body).Decode(&notif); err != nil {
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
 		return
 	}
-	emptyOrErrorResponse(w, server.d.LeaveEndpoint(&l))
+	emptyOrErrorResponse(w, server.d.DiscoverNew(r.Context(), &notif))
+}
+
+func (server *server) discoverDelete(w http.ResponseWriter, r *http.Request) {
+	var notif netApi.DiscoveryNotification
+	if err := json.NewDecoder(r.Body).Decode(&notif); err != nil {
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
+		return
+	}
+	emptyOrErrorResponse(w, server.d.DiscoverDelete(r.Context(), &notif))
+}
+
+func (server *server) programExternalConnectivity(w http.ResponseWriter, r *http.Request) {
+	var p ProgramExternalConnectivityRequest
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
+		return
+	}
+	emptyOrErrorResponse(w, server.d.ProgramExternalConnectivity(r.Context(), &p))
+}
+
+func (server *server) revokeExternalConnectivity(w http.ResponseWriter, r *http.Request) {
+	var revoke RevokeExternalConnectivityRequest
+	if err := json.NewDecoder(r.Body).Decode(&revoke); err != nil {
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
+		return
+	}
+	emptyOrErrorResponse(w, server.d.RevokeExternalConnectivity(r.Context(), &revoke))
 }
 
 func (server *server) getIPAMCapabilities(w http.ResponseWriter, r *http.Request) {
-	log.Info("Processing IPAM GetCapabilities Request")
-	caps, err := server.d.GetIPAMCapabilities()
-	objectOrErrorResponse(w, caps, err)
+	Logger(r.Context()).Info("Processing IPAM GetCapabilities Request")
+	caps, err := server.d.GetIPAMCapabilities(r.Context())
+	objectOrErrorResponse(w, r, caps, err)
 }
 
 func (server *server) getDefaultAddressSpaces(w http.ResponseWriter, r *http.Request) {
-	log.Info("Processing getDefaultAddressSpaces Request")
+	Logger(r.Context()).Info("Processing getDefaultAddressSpaces Request")
 	
-	spaces, err := server.d.GetDefaultAddressSpaces()
-	objectOrErrorResponse(w, spaces, err)
+	spaces, err := server.d.GetDefaultAddressSpaces(r.Context())
+	objectOrErrorResponse(w, r, spaces, err)
 }
 
 func (server *server) requestPool(w http.ResponseWriter, r *http.Request) {
-	log.Info("Processing requestPool Request")
+	Logger(r.Context()).Info("Processing requestPool Request")
 	var pool ipamApi.RequestPoolRequest
 	if err := json.NewDecoder(r.Body).Decode(&pool); err != nil {
-		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
 		return
 	}
 	
-	res, err := server.d.RequestPool(&pool)
-	objectOrErrorResponse(w, res, err)
+	res, err := server.d.RequestPool(r.Context(), &pool)
+	objectOrErrorResponse(w, r, res, err)
 }
 
 func (server *server) requestAddress(w http.ResponseWriter, r *http.Request) {
-	log.Info("Processing requestAddress Request")
+	Logger(r.Context()).Info("Processing requestAddress Request")
 	var address ipamApi.RequestAddressRequest
 	if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
-		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
 		return
 	}
 	
-	res, err := server.d.RequestAddress(&address)
-	objectOrErrorResponse(w, res, err)
+	res, err := server.d.RequestAddress(r.Context(), &address)
+	objectOrErrorResponse(w, r, res, err)
 }
 func (server *server) releaseAddress(w http.ResponseWriter, r *http.Request) {
-	log.Info("Processing releaseAddress Request")
+	Logger(r.Context()).Info("Processing releaseAddress Request")
 	var address ipamApi.ReleaseAddressRequest
 	if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
-		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
 		return
 	}
-	emptyOrErrorResponse(w, server.d.ReleaseAddress(&address))
+	emptyOrErrorResponse(w, server.d.ReleaseAddress(r.Context(), &address))
 }
 
 func (server *server) releasePool(w http.ResponseWriter, r *http.Request) {
-	log.Info("Processing releasePool Request")
+	Logger(r.Context()).Info("Processing releasePool Request")
 	var pool ipamApi.ReleasePoolRequest
 	if err := json.NewDecoder(r.Body).Decode(&pool); err != nil {
-		sendError(w, "Could not decode JSON encode payload", http.StatusBadRequest)
+		sendError(w, r, "Could not decode JSON encode payload", http.StatusBadRequest)
 		return
 	}
-	emptyOrErrorResponse(w, server.d.ReleasePool(&pool))
+	emptyOrErrorResponse(w, server.d.ReleasePool(r.Context(), &pool))
 }
 
 // Message processing
 
 func notFound(w http.ResponseWriter, r *http.Request) {
-	log.Warnf("plugin Not found: [ %+v ]", r)
-	http.NotFound(w, r)
+	sendError(w, r, fmt.Sprintf("%s not found", r.URL.Path), http.StatusNotFound)
 }
 
-func sendError(w http.ResponseWriter, msg string, code int) {
-	log.Errorf("%d %s", code, msg)
-	http.Error(w, msg, code)
+func sendError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	Logger(r.Context()).Errorf("%d %s", code, msg)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"Err": msg,
+	})
 }
 
 func errorResponse(w http.ResponseWriter, fmtString string, item ...interface{}) {
+	setFailed(w)
 	json.NewEncoder(w).Encode(map[string]string{
 		"Err": fmt.Sprintf(fmtString, item...),
 	})
 }
 
-func objectResponse(w http.ResponseWriter, obj interface{}) {
+func objectResponse(w http.ResponseWriter, r *http.Request, obj interface{}) {
 	if err := json.NewEncoder(w).Encode(obj); err != nil {
-		sendError(w, "Could not JSON encode response", http.StatusInternalServerError)
+		sendError(w, r, "Could not JSON encode response", http.StatusInternalServerError)
 		return
 	}
 }
@@ -244,17 +327,17 @@ func emptyResponse(w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(map[string]string{})
 }
 
-func objectOrErrorResponse(w http.ResponseWriter, obj interface{}, err error) {
+func objectOrErrorResponse(w http.ResponseWriter, r *http.Request, obj interface{}, err error) {
 	if err != nil {
-		errorResponse(w, err.Error())
+		errorResponse(w, "%s", err.Error())
 		return
 	}
-	objectResponse(w, obj)
+	objectResponse(w, r, obj)
 }
 
 func emptyOrErrorResponse(w http.ResponseWriter, err error) {
 	if err != nil {
-		errorResponse(w, err.Error())
+		errorResponse(w, "%s", err.Error())
 		return
 	}
 	emptyResponse(w)
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/jc-m/test-docker-plugin/routed/driver"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Names of the sockets passed by systemd, from FileDescriptorName=.
+// Unnamed sockets are taken in that order.
+const (
+	activationPlugin = "plugin"
+	activationAdmin  = "admin"
+)
+
+// first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// activationListeners returns the listeners passed by systemd socket
+// activation, by name. The sockets stay open in systemd, so that requests
+// queue up while the plugin restarts.
+func activationListeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := map[string]net.Listener{}
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	unnamed := []string{activationPlugin, activationAdmin}
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) && (names[i] == activationPlugin || names[i] == activationAdmin) {
+			name = names[i]
+		} else {
+			for len(unnamed) > 0 && listeners[unnamed[0]] != nil {
+				unnamed = unnamed[1:]
+			}
+			if len(unnamed) == 0 {
+				return nil, fmt.Errorf("unexpected socket %d passed by systemd", fd)
+			}
+			name = unnamed[0]
+		}
+		if listeners[name] != nil {
+			return nil, fmt.Errorf("two %s sockets passed by systemd", name)
+		}
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d passed by systemd: %s", fd, err)
+		}
+		log.Infof("Serving %s requests on %s from systemd", name, l.Addr())
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state to the service manager, if any.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Warnf("Unable to notify systemd: %s", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Warnf("Unable to notify systemd: %s", err)
+	}
+}
+
+// watchdog pings the systemd watchdog at half its interval, as long as the
+// driver answers: a deadlocked driver gets the plugin restarted.
+func watchdog(d driver.Plugin) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Debugf("Pinging the systemd watchdog every %s", interval)
+	for range time.Tick(interval) {
+		// takes the driver lock and every network and pool lock
+		d.Networks()
+		d.Pools()
+		sdNotify("WATCHDOG=1")
+	}
+}
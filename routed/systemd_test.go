@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// set in the environment of the test re-executed with the sockets passed
+// as by systemd, to the number of sockets
+const activationTestEnv = "ROUTED_TEST_ACTIVATION"
+
+func TestActivationListeners(t *testing.T) {
+	if fds := os.Getenv(activationTestEnv); fds != "" {
+		// the pid is only known here
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		os.Setenv("LISTEN_FDS", fds)
+		listeners, err := activationListeners()
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		for name, l := range listeners {
+			fmt.Printf("listener:%s=%s\n", name, filepath.Base(l.Addr().String()))
+		}
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "routed-activation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var files []*os.File
+	for _, name := range []string{"a.sock", "b.sock", "c.sock"} {
+		l, err := net.Listen("unix", filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.UnixListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	tests := []struct {
+		name    string
+		fds     int
+		fdNames string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "none", fds: 0, want: map[string]string{}},
+		{name: "unnamed", fds: 2, want: map[string]string{"plugin": "a.sock", "admin": "b.sock"}},
+		{name: "named", fds: 2, fdNames: "admin:plugin", want: map[string]string{"admin": "a.sock", "plugin": "b.sock"}},
+		{name: "admin named", fds: 2, fdNames: "other:admin", want: map[string]string{"plugin": "a.sock", "admin": "b.sock"}},
+		{name: "plugin only", fds: 1, fdNames: "plugin", want: map[string]string{"plugin": "a.sock"}},
+		{name: "too many", fds: 3, wantErr: true},
+		{name: "twice", fds: 2, fdNames: "plugin:plugin", wantErr: true},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestActivationListeners$")
+		cmd.Env = append(os.Environ(), activationTestEnv+"="+strconv.Itoa(tt.fds), "LISTEN_FDNAMES="+tt.fdNames)
+		cmd.ExtraFiles = files[:tt.fds]
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %s\n%s", tt.name, err, out)
+		}
+		got := map[string]string{}
+		gotErr := false
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "error:") {
+				gotErr = true
+			}
+			if strings.HasPrefix(line, "listener:") {
+				kv := strings.SplitN(strings.TrimPrefix(line, "listener:"), "=", 2)
+				got[kv[0]] = kv[1]
+			}
+		}
+		if gotErr != tt.wantErr {
+			t.Errorf("%s: error %t, want error %t\n%s", tt.name, gotErr, tt.wantErr, out)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}